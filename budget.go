@@ -0,0 +1,61 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrQueryBudget is returned by the lookups of a request that has
+// already used all of the queries allowed by the max_queries option.
+// The lookups answered by the cache or the static records don't count.
+var ErrQueryBudget = errors.New("the request exceeded the maximum number of DNS queries")
+
+// queryBudget counts the lookups made for a single request
+type queryBudget struct {
+	max  int32
+	used int32
+}
+
+// withQueryBudget adds the query budget to the request's context
+// if the number of queries is limited in the config
+func withQueryBudget(r *http.Request, c Config) *http.Request {
+	if c.MaxQueries <= 0 {
+		return r
+	}
+	budget := &queryBudget{max: int32(c.MaxQueries)}
+	return r.WithContext(context.WithValue(r.Context(), "dnsBudget", budget))
+}
+
+// takeQuery uses one query from the request's budget and returns
+// ErrQueryBudget if there are no queries left
+func takeQuery(ctx context.Context) error {
+	budget, ok := ctx.Value("dnsBudget").(*queryBudget)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt32(&budget.used, 1) > budget.max {
+		return ErrQueryBudget
+	}
+	return nil
+}
+
+// hasQueryBudget reports whether the request's lookups are limited
+func hasQueryBudget(ctx context.Context) bool {
+	_, ok := ctx.Value("dnsBudget").(*queryBudget)
+	return ok
+}
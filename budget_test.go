@@ -0,0 +1,256 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// countingSource counts the lookups sent to the map source
+type countingSource struct {
+	source  mapSource
+	lookups int32
+}
+
+func (s *countingSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	atomic.AddInt32(&s.lookups, 1)
+	return s.source.LookupTXT(ctx, zone)
+}
+
+func TestQueryBudget(t *testing.T) {
+	tests := []struct {
+		url        string
+		maxQueries int
+		location   string
+		lookups    int32
+	}{
+		{
+			url:      "https://path.budget.test/a/b/c/d/e/f",
+			location: "https://wildcard.target.test",
+			lookups:  8,
+		},
+		{
+			url:        "https://path.budget.test/a/b/c/d/e/f",
+			maxQueries: 4,
+			location:   "https://fallback.target.test",
+			lookups:    4,
+		},
+		{
+			url:      "https://a.b.c.budget.test",
+			location: "https://catchall.target.test",
+			lookups:  5,
+		},
+		{
+			url:        "https://a.b.c.budget.test",
+			maxQueries: 2,
+			location:   "https://fallback.target.test",
+			lookups:    2,
+		},
+	}
+	for i, test := range tests {
+		source := &countingSource{source: mapSource{
+			"_redirect.path.budget.test.":             {"v=txtv0;type=path;to=https://fallback.target.test"},
+			"_redirect._._._._._._.path.budget.test.": {"v=txtv0;to=https://wildcard.target.test;type=host"},
+			"_redirect._.budget.test.":                {"v=txtv0;to=https://catchall.target.test;type=host"},
+		}}
+		c := Config{
+			Enable:     []string{"host", "path"},
+			Redirect:   "https://fallback.target.test",
+			MaxQueries: test.maxQueries,
+			// The wildcard walk reaches _.budget.test without a budget
+			WildcardDepth: 3,
+			Source:        source,
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+		if lookups := atomic.LoadInt32(&source.lookups); lookups != test.lookups {
+			t.Errorf("Test %d: Expected %d lookups, got %d", i, test.lookups, lookups)
+		}
+	}
+}
+
+func TestQueryBudgetRegexRecord(t *testing.T) {
+	tests := []struct {
+		maxQueries int
+		location   string
+		lookups    int32
+	}{
+		{
+			// The root record, the two subzones and the missing third one
+			maxQueries: 4,
+			location:   "https://two.target.test",
+			lookups:    4,
+		},
+		{
+			// The budget runs out on the third subzone
+			maxQueries: 3,
+			location:   "https://fallback.target.test",
+			lookups:    3,
+		},
+	}
+	for i, test := range tests {
+		source := &countingSource{source: mapSource{
+			"_redirect.regex.budget.test.":   {"v=txtv1;type=path;re=record"},
+			"_redirect.1.regex.budget.test.": {"v=txtv1;to=https://one.target.test;re=^/one$"},
+			"_redirect.2.regex.budget.test.": {"v=txtv1;to=https://two.target.test;re=^/two$"},
+		}}
+		c := Config{
+			Enable:     []string{"host", "path"},
+			Redirect:   "https://fallback.target.test",
+			MaxQueries: test.maxQueries,
+			Source:     source,
+		}
+		req := httptest.NewRequest("GET", "https://regex.budget.test/two", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+		if lookups := atomic.LoadInt32(&source.lookups); lookups != test.lookups {
+			t.Errorf("Test %d: Expected %d lookups, got %d", i, test.lookups, lookups)
+		}
+	}
+}
+
+func TestQueryBudgetCache(t *testing.T) {
+	source := &countingSource{source: mapSource{
+		"_redirect.a.budget.test.": {"v=txtv0;to=https://a.target.test"},
+		"_redirect.b.budget.test.": {"v=txtv0;to=https://b.target.test"},
+		"_redirect.c.budget.test.": {"v=txtv0;to=https://c.target.test"},
+	}}
+	c := Config{Cache: &Cache{}, Source: source}
+
+	// Warm up the cache
+	for _, zone := range []string{"a", "b", "c"} {
+		if _, err := query("_redirect."+zone+".budget.test.", context.Background(), c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	req := withQueryBudget(httptest.NewRequest("GET", "https://a.budget.test", nil), Config{MaxQueries: 2})
+	for _, zone := range []string{"a", "b", "c"} {
+		if _, err := query("_redirect."+zone+".budget.test.", req.Context(), c); err != nil {
+			t.Errorf("Expected the cached lookup of %s not to use the budget, got %s", zone, err)
+		}
+	}
+	if lookups := atomic.LoadInt32(&source.lookups); lookups != 3 {
+		t.Errorf("Expected 3 lookups, got %d", lookups)
+	}
+
+	if _, err := query("_redirect.d.budget.test.", req.Context(), c); err != nil && err != ErrNotFound {
+		t.Errorf("Expected the budget to be left for the uncached lookups, got %s", err)
+	}
+}
+
+func TestQueryRetries(t *testing.T) {
+	tests := []struct {
+		failures int32
+		retries  int
+		err      bool
+	}{
+		{
+			failures: 2,
+			retries:  2,
+		},
+		{
+			failures: 2,
+			retries:  1,
+			err:      true,
+		},
+		{
+			failures: 1,
+			err:      true,
+		},
+	}
+	for i, test := range tests {
+		var queries int32
+		failures := test.failures
+		addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			if atomic.AddInt32(&queries, 1) <= failures {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
+			}
+			handleDNSRequest(w, r)
+		})
+
+		c := Config{Resolver: addr, QueryRetries: test.retries}
+		_, err := query("_redirect.about.host.host.example.com.", context.Background(), c)
+		shutdown()
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+		}
+		if expected := int32(test.retries + 1); !test.err && queries != expected {
+			t.Errorf("Test %d: Expected %d queries, got %d", i, expected, queries)
+		}
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	blackhole, shutdown := newBlackhole(t)
+	defer shutdown()
+
+	c := Config{Resolver: blackhole, QueryTimeout: 50 * time.Millisecond, QueryRetries: 1}
+	start := time.Now()
+	if _, err := query("_redirect.about.host.host.example.com.", context.Background(), c); err == nil {
+		t.Fatal("Expected the lookup to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected both attempts to time out after 50ms, took %s", elapsed)
+	}
+}
+
+func TestParseQueryLimits(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`txtdirect {
+		query_timeout 2s
+		query_retries 3
+		max_queries 25
+	}`)
+	c, err := ParseCaddy(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.QueryTimeout != 2*time.Second || c.QueryRetries != 3 || c.MaxQueries != 25 {
+		t.Errorf("Unexpected query limits: %s %d %d", c.QueryTimeout, c.QueryRetries, c.MaxQueries)
+	}
+
+	for i, config := range []string{
+		"query_timeout never",
+		"query_retries -1",
+		"max_queries 0",
+	} {
+		d := caddyfile.NewTestDispenser("txtdirect {\n" + config + "\n}")
+		if _, err := ParseCaddy(d); err == nil {
+			t.Errorf("Test %d: Expected %s to fail the config", i, config)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const (
+	defaultCacheSize        = 4096
+	defaultCacheMaxTTL      = time.Hour
+	defaultCacheNegativeTTL = time.Minute
+	defaultCacheUnknownTTL  = 30 * time.Second
+
+	// staleRetryInterval is the minimum time between the background
+	// refreshes of a record that is served stale
+	staleRetryInterval  = 5 * time.Second
+	staleRefreshTimeout = 30 * time.Second
+
+	defaultPrefetchWindow = 10 * time.Second
+
+	// unknownTTL is used when the lookup can't tell the record's TTL.
+	// Records with a negative TTL are cached for the cache's UnknownTTL.
+	unknownTTL time.Duration = -1
+)
+
+// Cache keeps the TXT records of the looked up zones in memory until
+// their TTL expires. Missing records are cached using the negative TTL.
+// The records looked up with the system resolver don't have a TTL and are
+// cached for the short UnknownTTL, so their changes are picked up quickly.
+// Found and missing records are kept for the Stale window after they expire
+// and are served stale if they can't be refreshed, e.g. when DNS is
+// unreachable. Keeping the missing records too means the hosts served by
+// the wildcard records don't wait for the unreachable zones either.
+// Records with at least PrefetchHits hits are refreshed in the background
+// when they're about to expire in the PrefetchWindow.
+type Cache struct {
+	Size           int           `json:"size,omitempty"`
+	MaxTTL         time.Duration `json:"max_ttl,omitempty"`
+	NegativeTTL    time.Duration `json:"negative_ttl,omitempty"`
+	UnknownTTL     time.Duration `json:"unknown_ttl,omitempty"`
+	Stale          time.Duration `json:"stale,omitempty"`
+	PrefetchHits   int           `json:"prefetch_hits,omitempty"`
+	PrefetchWindow time.Duration `json:"prefetch_window,omitempty"`
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	failing map[string]*staleState
+}
+
+type cacheEntry struct {
+	zone    string
+	txts    []string
+	err     error
+	expires time.Time
+
+	// hits and prefetching are guarded by the cache's mutex
+	hits        int
+	prefetching bool
+}
+
+// staleState keeps track of the background refreshes of
+// a zone that is served stale
+type staleState struct {
+	refreshing bool
+	retry      time.Time
+}
+
+// lookup returns the cached result for the given absolute zone and uses
+// fetch to query the zone when it's not cached or the entry has expired.
+// Expired records are served stale if they can't be refreshed and are
+// refreshed in the background instead. It calls fetch directly if the
+// cache isn't enabled.
+func (ca *Cache) lookup(ctx context.Context, zone string, fetch func(ctx context.Context) ([]string, time.Duration, error)) ([]string, error) {
+	if ca == nil {
+		txts, _, err := fetch(ctx)
+		return txts, err
+	}
+
+	// Callers are allowed to modify the returned records, so the
+	// cache only hands out copies of its entries
+	entry, stale := ca.get(zone)
+	if entry != nil && !stale {
+		if ca.hit(entry) {
+			go func() {
+				if err := ca.refresh(zone, fetch); err != nil {
+					log.Printf("[txtdirect]: Couldn't prefetch the record of %s: %s", zone, err.Error())
+				}
+			}()
+		}
+		return copyTXTs(entry.txts), entry.err
+	}
+
+	// Don't make the request wait for the failing lookups again
+	if stale && ca.isFailing(zone) {
+		return ca.serveStale(zone, entry, fetch)
+	}
+
+	txts, ttl, err := fetch(ctx)
+	if stale && err != nil && err != ErrNotFound {
+		log.Printf("[txtdirect]: Couldn't refresh the record of %s: %s", zone, err.Error())
+		return ca.serveStale(zone, entry, fetch)
+	}
+	ca.set(zone, copyTXTs(txts), ttl, err)
+	return txts, err
+}
+
+// get returns the cache entry of the given zone or nil if the zone isn't
+// cached or its entry has expired. Expired entries are returned with stale
+// set to true while they're in the stale window.
+func (ca *Cache) get(zone string) (entry *cacheEntry, stale bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.init()
+
+	elem, ok := ca.entries[zone]
+	if !ok {
+		return nil, false
+	}
+	entry = elem.Value.(*cacheEntry)
+	if now := time.Now(); now.After(entry.expires) {
+		if now.Before(entry.expires.Add(ca.Stale)) {
+			return entry, true
+		}
+		ca.order.Remove(elem)
+		delete(ca.entries, zone)
+		delete(ca.failing, zone)
+		return nil, false
+	}
+	ca.order.MoveToFront(elem)
+	return entry, false
+}
+
+// hit counts a hit on the given fresh entry and reports whether the
+// entry is hot enough and close enough to its expiry to be prefetched
+func (ca *Cache) hit(entry *cacheEntry) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	entry.hits++
+	if ca.PrefetchHits == 0 || entry.prefetching || entry.hits < ca.PrefetchHits {
+		return false
+	}
+	if time.Until(entry.expires) > ca.PrefetchWindow {
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// isFailing reports whether the last refresh of the given zone has failed
+func (ca *Cache) isFailing(zone string) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	_, ok := ca.failing[zone]
+	return ok
+}
+
+// serveStale returns the records or the ErrNotFound of the given expired
+// entry and starts a background refresh unless one has been tried recently
+func (ca *Cache) serveStale(zone string, entry *cacheEntry, fetch func(ctx context.Context) ([]string, time.Duration, error)) ([]string, error) {
+	ca.mu.Lock()
+	state, ok := ca.failing[zone]
+	if !ok {
+		state = &staleState{}
+		ca.failing[zone] = state
+	}
+	refresh := !state.refreshing && !time.Now().Before(state.retry)
+	if refresh {
+		state.refreshing = true
+	}
+	ca.mu.Unlock()
+
+	if refresh {
+		go func() {
+			if err := ca.refresh(zone, fetch); err != nil {
+				log.Printf("[txtdirect]: Couldn't refresh the stale record of %s: %s", zone, err.Error())
+				ca.mu.Lock()
+				state.refreshing = false
+				state.retry = time.Now().Add(staleRetryInterval)
+				ca.mu.Unlock()
+			}
+		}()
+	}
+
+	log.Printf("[txtdirect]: Serving stale record of %s", zone)
+	return copyTXTs(entry.txts), entry.err
+}
+
+// refresh looks up the given zone without the request's context and
+// replaces the cached entry unless the lookup fails temporarily
+func (ca *Cache) refresh(zone string, fetch func(ctx context.Context) ([]string, time.Duration, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), staleRefreshTimeout)
+	defer cancel()
+
+	txts, ttl, err := fetch(ctx)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	ca.set(zone, txts, ttl, err)
+	return nil
+}
+
+// set stores the lookup result for the given zone. Only found records and
+// missing records are cached, other errors are considered temporary.
+func (ca *Cache) set(zone string, txts []string, ttl time.Duration, err error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.init()
+
+	limit := ca.MaxTTL
+	if err != nil {
+		if err != ErrNotFound {
+			return
+		}
+		limit = ca.NegativeTTL
+	}
+	if ttl < 0 {
+		ttl = ca.UnknownTTL
+	}
+	if ttl > limit {
+		ttl = limit
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		zone:    zone,
+		txts:    txts,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+	delete(ca.failing, zone)
+	if elem, ok := ca.entries[zone]; ok {
+		elem.Value = entry
+		ca.order.MoveToFront(elem)
+		return
+	}
+	ca.entries[zone] = ca.order.PushFront(entry)
+
+	// Evict the least recently used entries
+	for ca.order.Len() > ca.Size {
+		last := ca.order.Back()
+		ca.order.Remove(last)
+		delete(ca.entries, last.Value.(*cacheEntry).zone)
+		delete(ca.failing, last.Value.(*cacheEntry).zone)
+	}
+}
+
+// init prepares the cache for the first use. The cache can be created
+// from a JSON config, so the defaults are applied here too.
+func (ca *Cache) init() {
+	if ca.entries != nil {
+		return
+	}
+	ca.SetDefaults()
+	ca.entries = make(map[string]*list.Element)
+	ca.order = list.New()
+	ca.failing = make(map[string]*staleState)
+}
+
+// ParseCache parses the config for the record cache
+func (ca *Cache) ParseCache(c *caddyfile.Dispenser) error {
+	switch c.Val() {
+	case "size":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("<Cache>: Couldn't parse the size")
+		}
+		ca.Size = value
+	case "max_ttl":
+		value, err := parseDurationArg(c)
+		if err != nil {
+			return fmt.Errorf("<Cache>: Couldn't parse the max_ttl: %s", err.Error())
+		}
+		ca.MaxTTL = value
+	case "negative_ttl":
+		value, err := parseDurationArg(c)
+		if err != nil {
+			return fmt.Errorf("<Cache>: Couldn't parse the negative_ttl: %s", err.Error())
+		}
+		ca.NegativeTTL = value
+	case "unknown_ttl":
+		value, err := parseDurationArg(c)
+		if err != nil {
+			return fmt.Errorf("<Cache>: Couldn't parse the unknown_ttl: %s", err.Error())
+		}
+		ca.UnknownTTL = value
+	case "stale":
+		value, err := parseDurationArg(c)
+		if err != nil {
+			return fmt.Errorf("<Cache>: Couldn't parse the stale window: %s", err.Error())
+		}
+		ca.Stale = value
+	case "prefetch":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		hits, err := strconv.Atoi(args[0])
+		if err != nil || hits < 1 {
+			return fmt.Errorf("<Cache>: Couldn't parse the prefetch hits")
+		}
+		ca.PrefetchHits = hits
+		if len(args) == 2 {
+			window, err := time.ParseDuration(args[1])
+			if err != nil {
+				return fmt.Errorf("<Cache>: Couldn't parse the prefetch window: %s", err.Error())
+			}
+			ca.PrefetchWindow = window
+		}
+	default:
+		return c.ArgErr() // unhandled option for cache config
+	}
+	return nil
+}
+
+// SetDefaults sets the default values for the cache config
+func (ca *Cache) SetDefaults() {
+	if ca.Size == 0 {
+		ca.Size = defaultCacheSize
+	}
+	if ca.MaxTTL == 0 {
+		ca.MaxTTL = defaultCacheMaxTTL
+	}
+	if ca.NegativeTTL == 0 {
+		ca.NegativeTTL = defaultCacheNegativeTTL
+	}
+	if ca.UnknownTTL == 0 {
+		ca.UnknownTTL = defaultCacheUnknownTTL
+	}
+	if ca.PrefetchHits != 0 && ca.PrefetchWindow == 0 {
+		ca.PrefetchWindow = defaultPrefetchWindow
+	}
+}
+
+func copyTXTs(txts []string) []string {
+	if txts == nil {
+		return nil
+	}
+	return append([]string{}, txts...)
+}
+
+// parseDurationArg parses the only argument of the current line as a duration
+func parseDurationArg(c *caddyfile.Dispenser) (time.Duration, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	return time.ParseDuration(args[0])
+}
@@ -0,0 +1,535 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCacheLookup(t *testing.T) {
+	tests := []struct {
+		txts    []string
+		ttl     time.Duration
+		err     error
+		fetches int
+		expires time.Duration
+	}{
+		{
+			txts:    []string{"v=txtv0;to=https://example.test"},
+			ttl:     time.Minute,
+			fetches: 1,
+			expires: time.Minute,
+		},
+		{
+			txts:    []string{"v=txtv0;to=https://example.test"},
+			ttl:     48 * time.Hour,
+			fetches: 1,
+			expires: time.Hour,
+		},
+		{
+			txts: []string{"v=txtv0;to=https://example.test"},
+			// The system resolver doesn't tell the TTL
+			ttl:     unknownTTL,
+			fetches: 1,
+			expires: defaultCacheUnknownTTL,
+		},
+		{
+			txts:    []string{"v=txtv0;to=https://example.test"},
+			ttl:     0,
+			fetches: 3,
+		},
+		{
+			err:     ErrNotFound,
+			ttl:     time.Hour,
+			fetches: 1,
+			expires: 30 * time.Second,
+		},
+		{
+			err:     ErrNotFound,
+			ttl:     10 * time.Second,
+			fetches: 1,
+			expires: 10 * time.Second,
+		},
+		{
+			err:     fmt.Errorf("could not get TXT record: i/o timeout"),
+			ttl:     0,
+			fetches: 3,
+		},
+	}
+	for i, test := range tests {
+		cache := &Cache{MaxTTL: time.Hour, NegativeTTL: 30 * time.Second}
+		fetches := 0
+		fetch := func(ctx context.Context) ([]string, time.Duration, error) {
+			fetches++
+			return copyTXTs(test.txts), test.ttl, test.err
+		}
+
+		for j := 0; j < 3; j++ {
+			txts, err := cache.lookup(context.Background(), "_redirect.example.test.", fetch)
+			if err != test.err {
+				t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			}
+			if len(txts) != len(test.txts) {
+				t.Fatalf("Test %d: Expected %d records, got %d", i, len(test.txts), len(txts))
+			}
+			// Modifying the returned records shouldn't change the cached records
+			for k := range txts {
+				txts[k] = "modified"
+			}
+		}
+
+		if fetches != test.fetches {
+			t.Errorf("Test %d: Expected %d fetches, got %d", i, test.fetches, fetches)
+		}
+
+		entry, _ := cache.get("_redirect.example.test.")
+		if test.expires == 0 {
+			if entry != nil {
+				t.Errorf("Test %d: Expected the result not to be cached", i)
+			}
+			continue
+		}
+		if entry == nil {
+			t.Fatalf("Test %d: Expected the result to be cached", i)
+		}
+		if ttl := time.Until(entry.expires); ttl > test.expires || ttl < test.expires-time.Second {
+			t.Errorf("Test %d: Expected the entry to expire in %s, got %s", i, test.expires, ttl)
+		}
+		for k, txt := range entry.txts {
+			if txt != test.txts[k] {
+				t.Errorf("Test %d: Expected cached record to be %s, got %s", i, test.txts[k], txt)
+			}
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := &Cache{}
+	fetches := 0
+	fetch := func(ctx context.Context) ([]string, time.Duration, error) {
+		fetches++
+		return []string{"v=txtv0;to=https://example.test"}, time.Minute, nil
+	}
+
+	cache.lookup(context.Background(), "_redirect.example.test.", fetch)
+	cache.entries["_redirect.example.test."].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	cache.lookup(context.Background(), "_redirect.example.test.", fetch)
+
+	if fetches != 2 {
+		t.Errorf("Expected the expired entry to be fetched again, got %d fetches", fetches)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	tests := []struct {
+		stale     time.Duration
+		expired   time.Duration
+		err       error
+		expected  string
+		lookupErr error
+	}{
+		{
+			// DNS is unreachable, the stale record is served
+			stale:    time.Hour,
+			expired:  time.Minute,
+			err:      fmt.Errorf("could not get TXT record: i/o timeout"),
+			expected: "v=txtv0;to=https://old.example.test",
+		},
+		{
+			// The stale window has passed
+			stale:     time.Hour,
+			expired:   2 * time.Hour,
+			err:       fmt.Errorf("could not get TXT record: i/o timeout"),
+			lookupErr: fmt.Errorf("could not get TXT record: i/o timeout"),
+		},
+		{
+			// The record was removed, so it shouldn't be served stale
+			stale:     time.Hour,
+			expired:   time.Minute,
+			err:       ErrNotFound,
+			lookupErr: ErrNotFound,
+		},
+		{
+			// Stale records are disabled by default
+			expired:   time.Minute,
+			err:       fmt.Errorf("could not get TXT record: i/o timeout"),
+			lookupErr: fmt.Errorf("could not get TXT record: i/o timeout"),
+		},
+	}
+	for i, test := range tests {
+		zone := "_redirect.example.test."
+		cache := &Cache{Stale: test.stale}
+		cache.lookup(context.Background(), zone, func(ctx context.Context) ([]string, time.Duration, error) {
+			return []string{"v=txtv0;to=https://old.example.test"}, time.Minute, nil
+		})
+		cache.entries[zone].Value.(*cacheEntry).expires = time.Now().Add(-test.expired)
+
+		// The background refresh outlives the iteration
+		fetchErr := test.err
+		txts, err := cache.lookup(context.Background(), zone, func(ctx context.Context) ([]string, time.Duration, error) {
+			return nil, 0, fetchErr
+		})
+		if fmt.Sprint(err) != fmt.Sprint(test.lookupErr) {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.lookupErr, err)
+			continue
+		}
+		if test.lookupErr == nil && txts[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txts[0])
+		}
+	}
+}
+
+func TestCacheStaleRefresh(t *testing.T) {
+	zone := "_redirect.example.test."
+	cache := &Cache{Stale: time.Hour}
+	cache.lookup(context.Background(), zone, func(ctx context.Context) ([]string, time.Duration, error) {
+		return []string{"v=txtv0;to=https://old.example.test"}, time.Minute, nil
+	})
+	cache.entries[zone].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+
+	var fetches int32
+	var down int32 = 1
+	refreshed := make(chan struct{}, 10)
+	fetch := func(ctx context.Context) ([]string, time.Duration, error) {
+		atomic.AddInt32(&fetches, 1)
+		defer func() { refreshed <- struct{}{} }()
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, 0, fmt.Errorf("could not get TXT record: i/o timeout")
+		}
+		return []string{"v=txtv0;to=https://new.example.test"}, time.Minute, nil
+	}
+
+	// The first request waits for the failing lookup and starts a background
+	// refresh, the following requests are served stale without waiting
+	for j := 0; j < 3; j++ {
+		txts, err := cache.lookup(context.Background(), zone, fetch)
+		if err != nil || txts[0] != "v=txtv0;to=https://old.example.test" {
+			t.Fatalf("Expected the stale record, got %v %v", txts, err)
+		}
+	}
+	<-refreshed
+	<-refreshed
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected a single background refresh, got %d fetches", n)
+	}
+
+	// DNS is back, the next retry replaces the stale record
+	atomic.StoreInt32(&down, 0)
+	cache.mu.Lock()
+	cache.failing[zone].retry = time.Time{}
+	cache.mu.Unlock()
+	cache.lookup(context.Background(), zone, fetch)
+	<-refreshed
+
+	txts, err := cache.lookup(context.Background(), zone, fetch)
+	if err != nil || txts[0] != "v=txtv0;to=https://new.example.test" {
+		t.Errorf("Expected the refreshed record, got %v %v", txts, err)
+	}
+}
+
+// outageSource serves the map source's records with a minute long TTL for
+// the missing records too, and fails slowly while DNS is down
+type outageSource struct {
+	source mapSource
+	down   int32
+}
+
+func (s *outageSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	if atomic.LoadInt32(&s.down) == 1 {
+		time.Sleep(100 * time.Millisecond)
+		return nil, 0, fmt.Errorf("could not get TXT record: i/o timeout")
+	}
+	txts, _, err := s.source.LookupTXT(ctx, zone)
+	return txts, time.Minute, err
+}
+
+func TestCacheStaleWildcard(t *testing.T) {
+	source := &outageSource{source: mapSource{
+		"_redirect._.wildcard.test.": {"v=txtv0;to=https://wildcard.target.test;type=host"},
+	}}
+	c := Config{
+		Enable: []string{"host"},
+		Cache:  &Cache{Stale: time.Hour},
+		Source: source,
+	}
+	redirect := func() string {
+		req := httptest.NewRequest("GET", "https://a.wildcard.test", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return resp.Header().Get("Location")
+	}
+	redirect()
+
+	// Both the missing zones and the wildcard expire while DNS is down
+	c.Cache.mu.Lock()
+	for _, e := range c.Cache.entries {
+		e.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	}
+	c.Cache.mu.Unlock()
+	atomic.StoreInt32(&source.down, 1)
+
+	// The first request waits for the failing lookups, the following ones
+	// are served from the stale missing zones and the stale wildcard
+	if location := redirect(); location != "https://wildcard.target.test" {
+		t.Fatalf("Expected the stale wildcard record, got %q", location)
+	}
+	start := time.Now()
+	if location := redirect(); location != "https://wildcard.target.test" {
+		t.Fatalf("Expected the stale wildcard record, got %q", location)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("Expected the request not to wait for the failing lookups, took %s", elapsed)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	tests := []struct {
+		hits     int
+		window   time.Duration
+		ttl      time.Duration
+		lookups  int
+		prefetch bool
+	}{
+		{
+			// Hot record that is about to expire
+			hits:     3,
+			window:   time.Minute,
+			ttl:      30 * time.Second,
+			lookups:  4,
+			prefetch: true,
+		},
+		{
+			// Not enough hits yet
+			hits:    3,
+			window:  time.Minute,
+			ttl:     30 * time.Second,
+			lookups: 3,
+		},
+		{
+			// Not close to its expiry
+			hits:    3,
+			window:  time.Minute,
+			ttl:     time.Hour,
+			lookups: 10,
+		},
+		{
+			// Prefetching is disabled by default
+			ttl:     time.Second,
+			lookups: 10,
+		},
+	}
+	for i, test := range tests {
+		zone := "_redirect.example.test."
+		cache := &Cache{PrefetchHits: test.hits, PrefetchWindow: test.window}
+		var fetches int32
+		prefetched := make(chan struct{}, 10)
+		ttl := test.ttl
+		fetch := func(ctx context.Context) ([]string, time.Duration, error) {
+			if atomic.AddInt32(&fetches, 1) > 1 {
+				defer func() { prefetched <- struct{}{} }()
+				return []string{"v=txtv0;to=https://new.example.test"}, time.Hour, nil
+			}
+			return []string{"v=txtv0;to=https://old.example.test"}, ttl, nil
+		}
+
+		for j := 0; j < test.lookups; j++ {
+			txts, err := cache.lookup(context.Background(), zone, fetch)
+			// Prefetching never makes the request wait
+			if err != nil || txts[0] != "v=txtv0;to=https://old.example.test" {
+				t.Fatalf("Test %d: Expected the cached record, got %v %v", i, txts, err)
+			}
+		}
+
+		if !test.prefetch {
+			time.Sleep(10 * time.Millisecond)
+			if n := atomic.LoadInt32(&fetches); n != 1 {
+				t.Errorf("Test %d: Expected no prefetch, got %d fetches", i, n)
+			}
+			continue
+		}
+
+		<-prefetched
+		if n := atomic.LoadInt32(&fetches); n != 2 {
+			t.Errorf("Test %d: Expected a single prefetch, got %d fetches", i, n)
+		}
+		txts, _ := cache.lookup(context.Background(), zone, fetch)
+		if txts[0] != "v=txtv0;to=https://new.example.test" {
+			t.Errorf("Test %d: Expected the prefetched record, got %s", i, txts[0])
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := &Cache{Size: 2}
+	fetch := func(ctx context.Context) ([]string, time.Duration, error) {
+		return []string{"v=txtv0;to=https://example.test"}, time.Minute, nil
+	}
+
+	cache.lookup(context.Background(), "_redirect.a.example.test.", fetch)
+	cache.lookup(context.Background(), "_redirect.b.example.test.", fetch)
+	// Use the first zone so the second one becomes the least recently used
+	cache.lookup(context.Background(), "_redirect.a.example.test.", fetch)
+	cache.lookup(context.Background(), "_redirect.c.example.test.", fetch)
+
+	for zone, cached := range map[string]bool{
+		"_redirect.a.example.test.": true,
+		"_redirect.b.example.test.": false,
+		"_redirect.c.example.test.": true,
+	} {
+		if entry, _ := cache.get(zone); (entry != nil) != cached {
+			t.Errorf("Expected %s to be cached: %t", zone, cached)
+		}
+	}
+}
+
+func Test_queryCache(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Cache:    &Cache{},
+	}
+	zone := "_redirect.about.host.host.example.com."
+	if _, err := query(zone, context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The testing DNS server answers with a TTL of 60 seconds
+	entry, _ := c.Cache.get(zone)
+	if entry == nil {
+		t.Fatalf("Expected %s to be cached", zone)
+	}
+	if ttl := time.Until(entry.expires); ttl > time.Minute || ttl < 59*time.Second {
+		t.Errorf("Expected the record's TTL to be used, got %s", ttl)
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	tests := []struct {
+		config      string
+		size        int
+		maxTTL      time.Duration
+		negativeTTL time.Duration
+		unknownTTL  time.Duration
+		stale       time.Duration
+		hits        int
+		window      time.Duration
+		err         bool
+	}{
+		{
+			config:      `cache`,
+			size:        defaultCacheSize,
+			maxTTL:      defaultCacheMaxTTL,
+			negativeTTL: defaultCacheNegativeTTL,
+			unknownTTL:  defaultCacheUnknownTTL,
+		},
+		{
+			config: `cache {
+				size 100
+				max_ttl 5m
+				negative_ttl 10s
+				unknown_ttl 1m
+				stale 1h
+			}`,
+			size:        100,
+			maxTTL:      5 * time.Minute,
+			negativeTTL: 10 * time.Second,
+			unknownTTL:  time.Minute,
+			stale:       time.Hour,
+		},
+		{
+			config: `cache {
+				prefetch 100
+			}`,
+			size:        defaultCacheSize,
+			maxTTL:      defaultCacheMaxTTL,
+			negativeTTL: defaultCacheNegativeTTL,
+			unknownTTL:  defaultCacheUnknownTTL,
+			hits:        100,
+			window:      defaultPrefetchWindow,
+		},
+		{
+			config: `cache {
+				prefetch 10 30s
+			}`,
+			size:        defaultCacheSize,
+			maxTTL:      defaultCacheMaxTTL,
+			negativeTTL: defaultCacheNegativeTTL,
+			unknownTTL:  defaultCacheUnknownTTL,
+			hits:        10,
+			window:      30 * time.Second,
+		},
+		{
+			config: `cache {
+				prefetch 0
+			}`,
+			err: true,
+		},
+		{
+			config: `cache {
+				size none
+			}`,
+			err: true,
+		},
+		{
+			config: `cache {
+				unknown 1h
+			}`,
+			err: true,
+		},
+	}
+	for i, test := range tests {
+		d := caddyfile.NewTestDispenser("txtdirect {\n" + test.config + "\n}")
+		c, err := ParseCaddy(d)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if c.Cache == nil {
+			t.Fatalf("Test %d: Expected the cache to be enabled", i)
+		}
+		if c.Cache.Size != test.size {
+			t.Errorf("Test %d: Expected size to be %d, got %d", i, test.size, c.Cache.Size)
+		}
+		if c.Cache.MaxTTL != test.maxTTL {
+			t.Errorf("Test %d: Expected max_ttl to be %s, got %s", i, test.maxTTL, c.Cache.MaxTTL)
+		}
+		if c.Cache.NegativeTTL != test.negativeTTL {
+			t.Errorf("Test %d: Expected negative_ttl to be %s, got %s", i, test.negativeTTL, c.Cache.NegativeTTL)
+		}
+		if c.Cache.UnknownTTL != test.unknownTTL {
+			t.Errorf("Test %d: Expected unknown_ttl to be %s, got %s", i, test.unknownTTL, c.Cache.UnknownTTL)
+		}
+		if c.Cache.Stale != test.stale {
+			t.Errorf("Test %d: Expected stale to be %s, got %s", i, test.stale, c.Cache.Stale)
+		}
+		if c.Cache.PrefetchHits != test.hits || c.Cache.PrefetchWindow != test.window {
+			t.Errorf("Test %d: Expected prefetch to be %d %s, got %d %s",
+				i, test.hits, test.window, c.Cache.PrefetchHits, c.Cache.PrefetchWindow)
+		}
+	}
+}
@@ -1,36 +1,270 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"go.txtdirect.org/txtdirect"
 )
 
+// recordOutput is the JSON output of a validated record
+type recordOutput struct {
+	File   string        `json:"file,omitempty"`
+	Zone   string        `json:"zone,omitempty"`
+	Record string        `json:"record"`
+	Valid  bool          `json:"valid"`
+	Fields *recordFields `json:"fields,omitempty"`
+	// Normalized is the canonical txtv1 record of the valid records
+	Normalized string              `json:"normalized,omitempty"`
+	Problems   []txtdirect.Problem `json:"problems"`
+}
+
+// recordFields are the parsed fields of a record with the defaults applied
+type recordFields struct {
+	Version string            `json:"version,omitempty"`
+	Type    string            `json:"type,omitempty"`
+	To      string            `json:"to,omitempty"`
+	Code    int               `json:"code,omitempty"`
+	Root    string            `json:"root,omitempty"`
+	From    string            `json:"from,omitempty"`
+	Re      string            `json:"re,omitempty"`
+	Index   []string          `json:"index,omitempty"`
+	Ref     bool              `json:"ref"`
+	Use     []string          `json:"use,omitempty"`
+	Vcs     string            `json:"vcs,omitempty"`
+	Website string            `json:"website,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// lintOutput is the JSON output of the zone files' records
+type lintOutput struct {
+	Files    []string       `json:"files"`
+	Valid    bool           `json:"valid"`
+	Errors   int            `json:"errors"`
+	Warnings int            `json:"warnings"`
+	Records  []recordOutput `json:"records"`
+}
+
+// errorOutput is the JSON output of the errors that stop the validation
+type errorOutput struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error"`
+}
+
+// defaultPatterns match the names of the zone files read from a directory
+const defaultPatterns = "*.zone,zonefile,db.*"
+
 func main() {
 	var types string
+	var origin string
+	var format string
+	var patterns string
 	var enabled []string
 
 	flag.StringVar(&types, "types", "host,path,dockerv2,gometa,proxy,git", "Enable type. Separated using commas like \"host,path,git\"")
+	flag.StringVar(&origin, "origin", "", "Origin of the relative names in the zone files")
+	flag.StringVar(&format, "format", "text", "Output format, \"text\" or \"json\"")
+	flag.StringVar(&patterns, "pattern", defaultPatterns, "Names of the zone files read from a directory. Separated using commas")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <TXT record | zone file | directory of zone files>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if format != "text" && format != "json" {
+		log.Fatalf("[txtdirect-validator]: Unknown output format %q", format)
+	}
+
 	enabled = strings.Split(types, ",")
 
 	config := txtdirect.Config{
 		Enable: enabled,
 	}
 
-	if len(os.Args) < 2 {
-		log.Fatalf("[txtdirect-validator]: A TXT record should be provided as a argument")
+	if flag.NArg() < 1 {
+		fatal(format, "A TXT record or a zone file should be provided as a argument")
 	}
 
-	_, err := txtdirect.ParseRecord(os.Args[1], nil, &http.Request{}, config)
-	if err != nil {
-		log.Fatalf("[txtdirect-validator]: Couldn't parse the record: %s", err.Error())
+	if _, err := os.Stat(flag.Arg(0)); err == nil {
+		lintZoneFiles(flag.Arg(0), origin, format, strings.Split(patterns, ","), config)
+		return
+	}
+
+	rec, problems := txtdirect.ValidateRecord(flag.Arg(0), config)
+	if format == "json" {
+		output := newRecordOutput(flag.Arg(0), rec, problems)
+		printJSON(output)
+		if !output.Valid {
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if txtdirect.HasErrors(problems) {
+		log.Fatalf("[txtdirect-validator]: The TXT record is invalid.")
 	}
 
 	log.Println("[txtdirect-validator]: The TXT record is valid.")
 }
+
+// lintZoneFiles validates the records of the given zone file or the zone
+// files inside the given directory and exits with 1 if there are errors
+func lintZoneFiles(path, origin, format string, patterns []string, config txtdirect.Config) {
+	files, err := findZoneFiles(path, patterns)
+	if err != nil {
+		fatal(format, "Couldn't read the zone files: "+err.Error())
+	}
+	if len(files) == 0 {
+		fatal(format, fmt.Sprintf("Couldn't find any zone files matching %q", strings.Join(patterns, ",")))
+	}
+
+	var zones []txtdirect.ZoneFile
+	for _, file := range files {
+		zones = append(zones, txtdirect.ZoneFile{Path: file, Origin: origin})
+	}
+
+	results, err := txtdirect.LintZoneFiles(zones, config)
+	if err != nil {
+		fatal(format, "Couldn't read the zone files: "+err.Error())
+	}
+
+	output := lintOutput{Files: files, Records: []recordOutput{}}
+	for _, result := range results {
+		// The zone files that couldn't be parsed don't have a zone
+		name := result.Zone
+		if name == "" {
+			name = result.File
+		}
+		for _, problem := range result.Problems {
+			if problem.Severity == txtdirect.SeverityError {
+				output.Errors++
+			} else {
+				output.Warnings++
+			}
+			if format == "text" {
+				fmt.Printf("%s %s\n", name, problem)
+			}
+		}
+
+		record := newRecordOutput(result.TXT, result.Record, result.Problems)
+		record.File = result.File
+		record.Zone = result.Zone
+		if result.TXT == "" {
+			record.Fields = nil
+		}
+		output.Records = append(output.Records, record)
+	}
+	output.Valid = output.Errors == 0
+
+	if format == "json" {
+		printJSON(output)
+		if !output.Valid {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !output.Valid {
+		log.Fatalf("[txtdirect-validator]: Found %d errors and %d warnings in %d zone files.", output.Errors, output.Warnings, len(zones))
+	}
+
+	log.Printf("[txtdirect-validator]: The zone files are valid with %d warnings.", output.Warnings)
+}
+
+// findZoneFiles returns the given zone file or the files inside the given
+// directory whose names match one of the patterns
+func findZoneFiles(path string, patterns []string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// The zone file given as the argument is always read
+		if file == path {
+			if info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+			return nil
+		}
+		// Skip the hidden files and directories such as .git
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		for _, pattern := range patterns {
+			matched, err := filepath.Match(strings.TrimSpace(pattern), info.Name())
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+			}
+			if matched {
+				files = append(files, file)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// newRecordOutput returns the JSON output of the given validated record
+func newRecordOutput(txt string, rec txtdirect.Record, problems []txtdirect.Problem) recordOutput {
+	output := recordOutput{
+		Record: txt,
+		Valid:  !txtdirect.HasErrors(problems),
+		Fields: &recordFields{
+			Version: rec.Version,
+			Type:    rec.Type,
+			To:      rec.To,
+			Code:    rec.Code,
+			Root:    rec.Root,
+			From:    rec.From,
+			Re:      rec.Re,
+			Index:   rec.Index,
+			Ref:     rec.Ref,
+			Use:     rec.Use,
+			Vcs:     rec.Vcs,
+			Website: rec.Website,
+			Headers: rec.Headers,
+		},
+		Problems: problems,
+	}
+	if output.Problems == nil {
+		output.Problems = []txtdirect.Problem{}
+	}
+	if output.Valid {
+		if normalized, err := rec.MarshalText(); err == nil {
+			output.Normalized = string(normalized)
+		}
+	}
+	return output
+}
+
+// fatal reports the error in the given output format and exits with 1
+func fatal(format, message string) {
+	if format == "json" {
+		printJSON(errorOutput{Error: message})
+		os.Exit(1)
+	}
+	log.Fatalf("[txtdirect-validator]: %s", message)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("[txtdirect-validator]: Couldn't write the output: %s", err.Error())
+	}
+}
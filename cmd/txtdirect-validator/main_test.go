@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindZoneFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-validator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory like e2e/host with the zone files next to the other files
+	for _, file := range []string{
+		"Corefile",
+		"main.go",
+		"txtdirect.config",
+		"zonefile",
+		"example.test.zone",
+		"db.example.test",
+		".hidden.zone",
+		filepath.Join("sub", "sub.example.test.zone"),
+		filepath.Join(".git", "config.zone"),
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		patterns []string
+		expected []string
+		err      bool
+	}{
+		{
+			path:     dir,
+			patterns: strings.Split(defaultPatterns, ","),
+			expected: []string{"db.example.test", "example.test.zone", "sub/sub.example.test.zone", "zonefile"},
+		},
+		{
+			path:     dir,
+			patterns: []string{"*.config", "Corefile"},
+			expected: []string{"Corefile", "txtdirect.config"},
+		},
+		{
+			// A zone file given as the argument is read whatever its name is
+			path:     filepath.Join(dir, "main.go"),
+			patterns: strings.Split(defaultPatterns, ","),
+			expected: []string{"main.go"},
+		},
+		{
+			path:     dir,
+			patterns: []string{"["},
+			err:      true,
+		},
+	}
+	for i, test := range tests {
+		files, err := findZoneFiles(test.path, test.patterns)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+
+		var names []string
+		for _, file := range files {
+			name, _ := filepath.Rel(dir, file)
+			names = append(names, filepath.ToSlash(name))
+		}
+		if strings.Join(names, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, names)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lookups coalesces the concurrent lookups made by query
+var lookups lookupGroup
+
+// lookupGroup makes sure only one lookup is in flight for each key.
+// Concurrent callers for the same key wait for that lookup and share
+// its result and error.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done chan struct{}
+	txts []string
+	ttl  time.Duration
+	err  error
+}
+
+// do calls fetch for the given key unless a lookup for the same key is
+// already in flight. The lookup runs in the background and isn't tied to
+// any of the callers, each caller stops waiting for it when its own
+// context is done.
+func (g *lookupGroup) do(ctx context.Context, key string, fetch func() ([]string, time.Duration, error)) ([]string, time.Duration, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &lookupCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.txts, call.ttl, call.err = fetch()
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		// The records are shared with the other callers, so every
+		// caller gets its own copy
+		return copyTXTs(call.txts), call.ttl, call.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// lookupKey returns the key used to coalesce the lookups of the given
+// absolute zone. Lookups are only coalesced when every setting that can
+// change their answer is the same: the resolvers and how they're queried,
+// the TLS settings and the DNSSEC validation with its trust anchors.
+func lookupKey(zone string, c Config) string {
+	return fmt.Sprintf("%q %s %s %s %d %s %q %q %s %q %s",
+		c.resolvers(), c.ResolverStrategy, c.ResolverTimeout, c.QueryTimeout, c.QueryRetries,
+		c.DoHMethod, c.TLSServerName, c.TLSCA, c.DNSSEC, c.TrustAnchors, zone)
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupGroup(t *testing.T) {
+	tests := []struct {
+		txts []string
+		err  error
+	}{
+		{
+			txts: []string{"v=txtv0;to=https://example.test"},
+		},
+		{
+			err: ErrNotFound,
+		},
+		{
+			err: fmt.Errorf("could not get TXT record: i/o timeout"),
+		},
+	}
+	for i, test := range tests {
+		var g lookupGroup
+		var fetches int32
+		release := make(chan struct{})
+		fetch := func() ([]string, time.Duration, error) {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+			return copyTXTs(test.txts), time.Minute, test.err
+		}
+
+		var wg sync.WaitGroup
+		for j := 0; j < 50; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				txts, ttl, err := g.do(context.Background(), "_redirect.example.test.", fetch)
+				if err != test.err {
+					t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+				}
+				if ttl != time.Minute {
+					t.Errorf("Test %d: Expected the shared TTL, got %s", i, ttl)
+				}
+				if len(txts) != len(test.txts) {
+					t.Errorf("Test %d: Expected %d records, got %d", i, len(test.txts), len(txts))
+				}
+			}()
+		}
+
+		// Give the callers some time to join the lookup in flight
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if fetches != 1 {
+			t.Errorf("Test %d: Expected a single lookup, got %d", i, fetches)
+		}
+	}
+}
+
+func TestLookupGroupKeys(t *testing.T) {
+	var g lookupGroup
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() ([]string, time.Duration, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return []string{"v=txtv0;to=https://example.test"}, time.Minute, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, zone := range []string{"_redirect.a.example.test.", "_redirect.b.example.test."} {
+		for _, resolver := range []string{"127.0.0.1:53", "127.0.0.2:53"} {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				g.do(context.Background(), key, fetch)
+			}(lookupKey(zone, Config{Resolver: resolver}))
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 4 {
+		t.Errorf("Expected a lookup for each zone and resolver, got %d", fetches)
+	}
+}
+
+func Test_lookupKey(t *testing.T) {
+	base := Config{Resolver: "127.0.0.1:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"a"}}
+	configs := []Config{
+		{Resolver: "127.0.0.1:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"b"}},
+		{Resolver: "127.0.0.1:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"a"}, TLSServerName: "dns.test"},
+		{Resolver: "127.0.0.1:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"a"}, TLSCA: "ca.pem"},
+		{Resolver: "127.0.0.1:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"a"}, QueryRetries: 2},
+		{Resolver: "127.0.0.1:53", DNSSEC: DNSSECPrefer, TrustAnchors: []string{"a"}},
+		{Resolver: "127.0.0.2:53", DNSSEC: DNSSECRequire, TrustAnchors: []string{"a"}},
+	}
+	key := lookupKey("_redirect.example.test.", base)
+	if other := lookupKey("_redirect.example.test.", base); other != key {
+		t.Errorf("Expected the same config to give the same key, got %s and %s", key, other)
+	}
+	for i, c := range configs {
+		if lookupKey("_redirect.example.test.", c) == key {
+			t.Errorf("Test %d: Expected the lookups with different settings not to be coalesced", i)
+		}
+	}
+}
+
+func TestLookupGroupCanceled(t *testing.T) {
+	var g lookupGroup
+	release := make(chan struct{})
+	defer close(release)
+	fetch := func() ([]string, time.Duration, error) {
+		<-release
+		return []string{"v=txtv0;to=https://example.test"}, time.Minute, nil
+	}
+
+	go g.do(context.Background(), "_redirect.example.test.", fetch)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := g.do(ctx, "_redirect.example.test.", fetch); err != context.DeadlineExceeded {
+		t.Errorf("Expected the waiting caller to stop with its context, got %v", err)
+	}
+}
+
+func TestLookupGroupLeaderCanceled(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(100 * time.Millisecond)
+		handleDNSRequest(w, r)
+	})
+	defer shutdown()
+	source := DNSSource{Config: Config{Resolver: addr}}
+
+	// The first request starts the lookup and disconnects
+	leader, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, _, err := source.LookupTXT(leader, "_redirect.about.host.host.example.com.")
+		leaderErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txts, _, err := source.LookupTXT(context.Background(), "_redirect.about.host.host.example.com.")
+			if err != nil {
+				t.Errorf("Expected the waiting callers to get the answer, got %v", err)
+				return
+			}
+			if len(txts) == 0 {
+				t.Error("Expected the waiting callers to get the records")
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-leaderErr; err != context.Canceled {
+		t.Errorf("Expected the canceled caller to stop with its context, got %v", err)
+	}
+	wg.Wait()
+}
@@ -1,11 +1,17 @@
 package txtdirect
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -13,18 +19,53 @@ var allOptions = []string{"host", "path", "gometa", "www"}
 
 // Config contains the middleware's configuration
 type Config struct {
-	Enable    []string `json:"enable"`
-	Redirect  string   `json:"redirect,omitempty"`
-	Resolver  string   `json:"resolver,omitempty"`
-	LogOutput string   `json:"logfile,omitempty"`
-	Qr        Qr
+	Enable           []string          `json:"enable"`
+	Redirect         string            `json:"redirect,omitempty"`
+	Resolver         string            `json:"resolver,omitempty"`
+	Resolvers        []string          `json:"resolvers,omitempty"`
+	ResolverStrategy string            `json:"resolver_strategy,omitempty"`
+	ResolverTimeout  time.Duration     `json:"resolver_timeout,omitempty"`
+	QueryTimeout     time.Duration     `json:"query_timeout,omitempty"`
+	QueryRetries     int               `json:"query_retries,omitempty"`
+	MaxQueries       int               `json:"max_queries,omitempty"`
+	DoHMethod        string            `json:"doh_method,omitempty"`
+	TLSServerName    string            `json:"tls_server_name,omitempty"`
+	TLSCA            string            `json:"tls_ca,omitempty"`
+	DNSSEC           string            `json:"dnssec,omitempty"`
+	TrustAnchors     []string          `json:"trust_anchors,omitempty"`
+	LogOutput        string            `json:"logfile,omitempty"`
+	Cache            *Cache            `json:"cache,omitempty"`
+	RecordsFile      *FileSource       `json:"records_file,omitempty"`
+	Records          map[string]string `json:"records,omitempty"`
+	WildcardDepth    int               `json:"wildcard_depth,omitempty"`
+	BaseZone         string            `json:"basezone,omitempty"`
+	Qr               Qr
+
+	// Source replaces the DNS lookups when it's set
+	Source RecordSource `json:"-"`
 }
 
 func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 	var enable []string
 	var redirect string
 	var resolver string
+	var resolvers []string
+	var strategy string
+	var resolverTimeout time.Duration
+	var queryTimeout time.Duration
+	var queryRetries int
+	var maxQueries int
+	var dohMethod string
+	var tlsServerName string
+	var tlsCA string
+	var dnssec string
+	var trustAnchors []string
 	var logfile string
+	var cache *Cache
+	var recordsFile *FileSource
+	var records map[string]string
+	var wildcardDepth int
+	var baseZone string
 
 	for d.Next() {
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
@@ -57,10 +98,162 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 
 			case "resolver":
 				resolverAddr := d.RemainingArgs()
-				if len(resolverAddr) != 1 {
+				if len(resolverAddr) == 0 {
+					return nil, d.ArgErr()
+				}
+				if len(resolverAddr) == 1 {
+					resolver = resolverAddr[0]
+					break
+				}
+				resolvers = resolverAddr
+
+			case "resolver_strategy":
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				strategy = args[0]
+				if !contains([]string{StrategyFailover, StrategyRoundRobin, StrategyRace}, strategy) {
+					return nil, d.Errf("unsupported resolver strategy %s", strategy)
+				}
+
+			case "resolver_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return nil, d.Errf("couldn't parse the resolver_timeout: %s", err.Error())
+				}
+				resolverTimeout = timeout
+
+			case "query_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil || timeout <= 0 {
+					return nil, d.Errf("couldn't parse the query_timeout: %v", err)
+				}
+				queryTimeout = timeout
+
+			case "query_retries":
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				retries, err := strconv.Atoi(args[0])
+				if err != nil || retries < 0 {
+					return nil, d.Errf("couldn't parse the query_retries %s", args[0])
+				}
+				queryRetries = retries
+
+			case "max_queries":
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil || max < 1 {
+					return nil, d.Errf("couldn't parse the max_queries %s", args[0])
+				}
+				maxQueries = max
+
+			case "doh_method":
+				method := d.RemainingArgs()
+				if len(method) != 1 {
+					return nil, d.ArgErr()
+				}
+				dohMethod = strings.ToUpper(method[0])
+				if dohMethod != http.MethodGet && dohMethod != http.MethodPost {
+					return nil, d.Errf("unsupported DNS-over-HTTPS method %s", method[0])
+				}
+
+			case "cache":
+				cache = &Cache{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					if err := cache.ParseCache(d); err != nil {
+						return nil, err
+					}
+				}
+				cache.SetDefaults()
+
+			case "tls_server_name":
+				serverName := d.RemainingArgs()
+				if len(serverName) != 1 {
+					return nil, d.ArgErr()
+				}
+				tlsServerName = serverName[0]
+
+			case "tls_ca":
+				caFile := d.RemainingArgs()
+				if len(caFile) != 1 {
+					return nil, d.ArgErr()
+				}
+				if _, err := loadCAPool(caFile[0]); err != nil {
+					return nil, d.Err(err.Error())
+				}
+				tlsCA = caFile[0]
+
+			case "dnssec":
+				mode := d.RemainingArgs()
+				if len(mode) != 1 {
+					return nil, d.ArgErr()
+				}
+				dnssec = mode[0]
+				if dnssec != DNSSECRequire && dnssec != DNSSECPrefer {
+					return nil, d.Errf("unsupported dnssec mode %s", dnssec)
+				}
+
+			case "trust_anchor":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return nil, d.ArgErr()
+				}
+				anchor := strings.Join(args, " ")
+				if _, err := parseTrustAnchor(anchor); err != nil {
+					return nil, d.Err(err.Error())
+				}
+				trustAnchors = append(trustAnchors, anchor)
+
+			case "records_file":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, d.ArgErr()
+				}
+				zone := ZoneFile{Path: args[0]}
+				if len(args) == 2 {
+					zone.Origin = args[1]
+				}
+				if recordsFile == nil {
+					recordsFile = &FileSource{}
+				}
+				recordsFile.Zones = append(recordsFile.Zones, zone)
+
+			case "record":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
 					return nil, d.ArgErr()
 				}
-				resolver = resolverAddr[0]
+				if records == nil {
+					records = map[string]string{}
+				}
+				records[args[0]] = args[1]
+
+			case "wildcard_depth":
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				depth, err := strconv.Atoi(args[0])
+				if err != nil || depth < 1 {
+					return nil, d.Errf("couldn't parse the wildcard_depth %s", args[0])
+				}
+				wildcardDepth = depth
+
+			case "basezone":
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				baseZone = strings.Trim(args[0], ".")
+				if _, ok := dns.IsDomainName(baseZone); !ok || baseZone == "" {
+					return nil, d.Errf("invalid basezone %s", args[0])
+				}
 
 			case "logfile":
 				logfile = "stdout"
@@ -73,16 +266,50 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 
 	}
 
+	// The system resolver doesn't return the signatures
+	if dnssec != "" && resolver == "" && len(resolvers) == 0 {
+		return nil, d.Err("dnssec requires a custom resolver")
+	}
+
+	// Fail early if the zone files can't be loaded
+	if recordsFile != nil {
+		if _, err := recordsFile.load(); err != nil {
+			return nil, d.Errf("couldn't load the records_file: %s", err.Error())
+		}
+	}
+
 	// If nothing is specified, enable everything
 	if enable == nil {
 		enable = allOptions
 	}
 
+	// Bad overrides should fail the config instead of the requests
+	overrides, err := parseOverrides(records, Config{Enable: enable, Redirect: redirect, BaseZone: baseZone})
+	if err != nil {
+		return nil, d.Err(err.Error())
+	}
+
 	conf := Config{
-		Enable:    enable,
-		Redirect:  redirect,
-		Resolver:  resolver,
-		LogOutput: logfile,
+		Enable:           enable,
+		Redirect:         redirect,
+		Resolver:         resolver,
+		Resolvers:        resolvers,
+		ResolverStrategy: strategy,
+		ResolverTimeout:  resolverTimeout,
+		QueryTimeout:     queryTimeout,
+		QueryRetries:     queryRetries,
+		MaxQueries:       maxQueries,
+		DoHMethod:        dohMethod,
+		TLSServerName:    tlsServerName,
+		TLSCA:            tlsCA,
+		DNSSEC:           dnssec,
+		TrustAnchors:     trustAnchors,
+		LogOutput:        logfile,
+		Cache:            cache,
+		RecordsFile:      recordsFile,
+		Records:          overrides,
+		WildcardDepth:    wildcardDepth,
+		BaseZone:         baseZone,
 	}
 
 	parseLogfile(logfile)
@@ -90,6 +317,28 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 	return &conf, nil
 }
 
+// parseOverrides validates the static records using ValidateRecord, rejects
+// the ones with errors and returns them keyed by their absolute zone
+func parseOverrides(records map[string]string, c Config) (map[string]string, error) {
+	if records == nil {
+		return nil, nil
+	}
+	overrides := make(map[string]string, len(records))
+	for host, txt := range records {
+		if _, ok := dns.IsDomainName(host); !ok {
+			return nil, fmt.Errorf("invalid record host %s", host)
+		}
+		_, problems := ValidateRecord(txt, c)
+		for _, problem := range problems {
+			if problem.Severity == SeverityError {
+				return nil, fmt.Errorf("invalid record for %s: %s", host, problem.Message)
+			}
+		}
+		overrides[strings.ToLower(absoluteZone(host, c))] = txt
+	}
+	return overrides, nil
+}
+
 func removeArrayFromArray(array, toBeRemoved []string) []string {
 	t := make([]string, len(array))
 	copy(t, array)
@@ -0,0 +1,489 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation modes
+const (
+	// DNSSECRequire rejects the answers that can't be validated
+	DNSSECRequire = "require"
+	// DNSSECPrefer logs the answers that can't be validated and uses them anyway
+	DNSSECPrefer = "prefer"
+)
+
+const (
+	// rootAnchor is the DS record of the root zone's KSK-2017 which is
+	// used when no trust anchor is set in the config
+	rootAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+	// dnssecMaxDepth limits how many zones are walked to reach a trust anchor
+	dnssecMaxDepth = 16
+	// dnssecKeysSize limits how many validated DNSKEY sets are kept
+	dnssecKeysSize = 1024
+)
+
+var errUnsigned = errors.New("the answer isn't signed")
+
+// dnssecKeys keeps the validated DNSKEY sets until their TTL expires
+var dnssecKeys = keyCache{entries: map[string]keyEntry{}}
+
+type keyCache struct {
+	mu      sync.Mutex
+	entries map[string]keyEntry
+}
+
+type keyEntry struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// validator validates the answers of a single lookup using the config's
+// resolvers and trust anchors
+type validator struct {
+	c       Config
+	anchors []dns.RR
+	// keysKey separates the cached keys validated with different anchors
+	keysKey string
+}
+
+// parseTrustAnchor parses a DS or DNSKEY record in the presentation format
+func parseTrustAnchor(anchor string) (dns.RR, error) {
+	rr, err := dns.NewRR(anchor)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the trust anchor: %s", err.Error())
+	}
+	switch rr.(type) {
+	case *dns.DS, *dns.DNSKEY:
+		return rr, nil
+	}
+	return nil, fmt.Errorf("the trust anchor must be a DS or DNSKEY record")
+}
+
+// newValidator returns a validator for the config's trust anchors
+func newValidator(c Config) (*validator, error) {
+	anchors := c.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = []string{rootAnchor}
+	}
+	v := &validator{c: c, keysKey: strings.Join(anchors, "\n")}
+	for _, anchor := range anchors {
+		rr, err := parseTrustAnchor(anchor)
+		if err != nil {
+			return nil, err
+		}
+		v.anchors = append(v.anchors, rr)
+	}
+	return v, nil
+}
+
+// validateAnswer checks the signatures of every RRset in the response's
+// answer section and validates the signing keys up to a trust anchor
+func validateAnswer(ctx context.Context, resp *dns.Msg, c Config) error {
+	v, err := newValidator(c)
+	if err != nil {
+		return err
+	}
+
+	rrsets, sigs := splitRRsets(resp.Answer)
+	for _, rrset := range rrsets {
+		if err := v.verifyRRset(ctx, rrset, sigs, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDenial checks that a NXDOMAIN or NODATA response is proven by
+// the signed NSEC or NSEC3 records of its authority section
+func validateDenial(ctx context.Context, resp *dns.Msg, c Config) error {
+	v, err := newValidator(c)
+	if err != nil {
+		return err
+	}
+	if len(resp.Question) == 0 {
+		return errors.New("the response doesn't have a question")
+	}
+	name := dns.Fqdn(strings.ToLower(resp.Question[0].Name))
+	qtype := resp.Question[0].Qtype
+
+	// Only the signatures made by the zones above the name can deny it
+	rrsets, allSigs := splitRRsets(resp.Ns)
+	var sigs []*dns.RRSIG
+	for _, sig := range allSigs {
+		if dns.IsSubDomain(sig.SignerName, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rrset := range rrsets {
+		switch rrset[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+		if err := v.verifyRRset(ctx, rrset, sigs, 0); err != nil {
+			return err
+		}
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return fmt.Errorf("%s: the denial %s", name, errUnsigned)
+	}
+
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	if len(nsecs) > 0 && nsecDenies(nsecs, name, qtype, nxdomain) {
+		return nil
+	}
+	if len(nsec3s) > 0 && nsec3Denies(nsec3s, name, qtype, nxdomain) {
+		return nil
+	}
+	return fmt.Errorf("the NSEC records don't prove that %s doesn't exist", name)
+}
+
+// nsecDenies reports whether the NSEC records prove that the name or its
+// record type doesn't exist as described in RFC 4035 section 5.4
+func nsecDenies(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, name) {
+				return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+			}
+			// The name is an empty non-terminal
+			if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		// The wildcard of the closest encloser must not exist either
+		labels := dns.CompareDomainName(name, nsec.Hdr.Name)
+		if n := dns.CompareDomainName(name, nsec.NextDomain); n > labels {
+			labels = n
+		}
+		wildcard := "*." + strings.Join(dns.SplitDomainName(name)[dns.CountLabel(name)-labels:], ".") + "."
+		if labels == 0 {
+			wildcard = "*."
+		}
+		for _, other := range nsecs {
+			if nsecCovers(other, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Denies reports whether the NSEC3 records prove that the name or its
+// record type doesn't exist as described in RFC 5155 section 8
+func nsec3Denies(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) bool {
+	match := func(name string) *dns.NSEC3 {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Hash == dns.SHA1 && nsec3.Match(name) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+	// Opt-out records don't prove anything about the unsigned delegations
+	covered := func(name string) bool {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Hash == dns.SHA1 && nsec3.Flags&1 == 0 && !nsec3.Match(name) && nsec3.Cover(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !nxdomain {
+		nsec3 := match(name)
+		return nsec3 != nil && !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME)
+	}
+
+	// The closest encloser exists, the next closer name and the wildcard
+	// of the closest encloser don't
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".") + "."
+		if match(encloser) == nil {
+			continue
+		}
+		nextCloser := strings.Join(labels[i-1:], ".") + "."
+		return covered(nextCloser) && covered("*."+encloser)
+	}
+	return false
+}
+
+// nsecCovers reports whether the name is between the NSEC record's owner
+// and next name in the canonical order
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if canonicalCompare(nsec.Hdr.Name, name) >= 0 {
+		return false
+	}
+	// The last NSEC record of the zone points back to the apex
+	return canonicalCompare(name, nsec.NextDomain) < 0 || canonicalCompare(nsec.NextDomain, nsec.Hdr.Name) <= 0
+}
+
+// canonicalCompare compares two names in the canonical DNS name order
+// defined in RFC 4034 section 6.1
+func canonicalCompare(a, b string) int {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(aLabels)-1, len(bLabels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if cmp := strings.Compare(aLabels[i], bLabels[j]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRRsets groups the given records by their name and type and
+// returns them separately from the signatures
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	var sigs []*dns.RRSIG
+	index := map[string]int{}
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", strings.ToLower(rr.Header().Name), rr.Header().Rrtype)
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets, sigs
+}
+
+// verifyRRset checks that at least one of the signatures covering the
+// given RRset is valid and made by a trusted key of the signer zone
+func (v *validator) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG, depth int) error {
+	hdr := rrset[0].Header()
+	err := fmt.Errorf("%s: %s", hdr.Name, errUnsigned)
+	for _, sig := range sigs {
+		if sig.TypeCovered != hdr.Rrtype || !strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			continue
+		}
+		if !dns.IsSubDomain(sig.SignerName, hdr.Name) {
+			err = fmt.Errorf("%s is signed by an unrelated zone %s", hdr.Name, sig.SignerName)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			err = fmt.Errorf("the signature of %s isn't valid at this time", hdr.Name)
+			continue
+		}
+		keys, keysErr := v.zoneKeys(ctx, dns.Fqdn(strings.ToLower(sig.SignerName)), depth)
+		if keysErr != nil {
+			err = keysErr
+			continue
+		}
+		for _, key := range keys {
+			if sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+		err = fmt.Errorf("bogus signature for %s", hdr.Name)
+	}
+	return err
+}
+
+// zoneKeys returns the validated DNSKEY set of the given zone. The set
+// must be signed by a key that matches a trust anchor or the DS records
+// published in the parent zone.
+func (v *validator) zoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, error) {
+	if depth > dnssecMaxDepth {
+		return nil, fmt.Errorf("couldn't reach a trust anchor for %s", zone)
+	}
+	if keys := dnssecKeys.get(v.keysKey + " " + zone); keys != nil {
+		return keys, nil
+	}
+
+	trusted, err := v.trustedKeys(ctx, zone, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.fetch(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, sigs := splitRRsets(resp.Answer)
+	var rrset []dns.RR
+	for _, set := range rrsets {
+		if set[0].Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(set[0].Header().Name, zone) {
+			rrset = set
+		}
+	}
+	if rrset == nil {
+		return nil, fmt.Errorf("%s doesn't have any DNSKEY records", zone)
+	}
+
+	var keys []*dns.DNSKEY
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	// The DNSKEY set is signed by one of the keys trusted by the parent
+	for _, sig := range sigs {
+		if sig.TypeCovered != dns.TypeDNSKEY || !sig.ValidityPeriod(time.Now()) {
+			continue
+		}
+		for _, key := range keys {
+			if trusted(key) && sig.Verify(key, rrset) == nil {
+				dnssecKeys.set(v.keysKey+" "+zone, keys, time.Duration(ttl)*time.Second)
+				return keys, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("couldn't validate the DNSKEY records of %s", zone)
+}
+
+// trustedKeys returns a function that reports whether the given key of the
+// zone is trusted by a trust anchor or the DS records of the parent zone
+func (v *validator) trustedKeys(ctx context.Context, zone string, depth int) (func(*dns.DNSKEY) bool, error) {
+	var ds []*dns.DS
+	var anchorKeys []*dns.DNSKEY
+	for _, rr := range v.anchors {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch anchor := rr.(type) {
+		case *dns.DS:
+			ds = append(ds, anchor)
+		case *dns.DNSKEY:
+			anchorKeys = append(anchorKeys, anchor)
+		}
+	}
+
+	if len(ds) == 0 && len(anchorKeys) == 0 {
+		if zone == "." {
+			return nil, fmt.Errorf("couldn't reach a trust anchor")
+		}
+		resp, err := v.fetch(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		rrsets, sigs := splitRRsets(resp.Answer)
+		for _, rrset := range rrsets {
+			if rrset[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(rrset[0].Header().Name, zone) {
+				continue
+			}
+			// The DS records are signed by the parent zone
+			if err := v.verifyRRset(ctx, rrset, sigs, depth+1); err != nil {
+				return nil, err
+			}
+			for _, rr := range rrset {
+				ds = append(ds, rr.(*dns.DS))
+			}
+		}
+		if len(ds) == 0 {
+			return nil, fmt.Errorf("%s doesn't have any DS records: %s", zone, errUnsigned)
+		}
+	}
+
+	return func(key *dns.DNSKEY) bool {
+		for _, anchor := range anchorKeys {
+			if key.Algorithm == anchor.Algorithm && key.Flags == anchor.Flags && key.PublicKey == anchor.PublicKey {
+				return true
+			}
+		}
+		for _, d := range ds {
+			if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+				continue
+			}
+			if keyDS := key.ToDS(d.DigestType); keyDS != nil && strings.EqualFold(keyDS.Digest, d.Digest) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// fetch sends a query with the DO bit set to the config's resolvers
+func (v *validator) fetch(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(ednsUDPSize, true)
+
+	resp, err := exchangeResolvers(ctx, m, v.c)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("couldn't get the %s records of %s: %s",
+			dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+func (kc *keyCache) get(key string) []*dns.DNSKEY {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	entry, ok := kc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(kc.entries, key)
+		return nil
+	}
+	return entry.keys
+}
+
+func (kc *keyCache) set(key string, keys []*dns.DNSKEY, ttl time.Duration) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if len(kc.entries) >= dnssecKeysSize {
+		kc.entries = map[string]keyEntry{}
+	}
+	kc.entries[key] = keyEntry{keys: keys, expires: time.Now().Add(ttl)}
+}
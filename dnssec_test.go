@@ -0,0 +1,387 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// signedZone is a zone signed by a single key for the tests
+type signedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSignedZone(t *testing.T, name string) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signedZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the signature of the given RRset valid from inception to expiration
+func (z *signedZone) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newTXT(name, txt string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{txt},
+	}
+}
+
+func newNSEC(name, next string, types ...uint16) *dns.NSEC {
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// newDNSSECServer serves the signed test. zone and its signed secure.test.
+// child zone and returns the server's address and the DS of the test. zone
+func newDNSSECServer(t *testing.T) (string, string, func()) {
+	parent := newSignedZone(t, "test.")
+	child := newSignedZone(t, "secure.test.")
+	inception, expiration := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	answers := map[string][]dns.RR{}
+	add := func(z *signedZone, rr dns.RR, sigInception, sigExpiration time.Time) {
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		answers[key] = append(answers[key], rr)
+		if z != nil {
+			answers[key] = append(answers[key], z.sign(t, []dns.RR{rr}, sigInception, sigExpiration))
+		}
+	}
+
+	add(parent, parent.key, inception, expiration)
+	add(parent, child.key.ToDS(dns.SHA256), inception, expiration)
+	add(child, child.key, inception, expiration)
+	add(child, newTXT("_redirect.valid.secure.test.", "v=txtv0;to=https://valid.test"), inception, expiration)
+	add(nil, newTXT("_redirect.unsigned.secure.test.", "v=txtv0;to=https://unsigned.test"), inception, expiration)
+	add(child, newTXT("_redirect.expired.secure.test.", "v=txtv0;to=https://expired.test"),
+		time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	// The answer is changed after it's signed
+	bogus := newTXT("_redirect.bogus.secure.test.", "v=txtv0;to=https://bogus.test")
+	add(child, bogus, inception, expiration)
+	bogus.Txt = []string{"v=txtv0;to=https://attacker.test"}
+
+	// A validly signed record of another name is sent as the answer of
+	// the victim zone and the mismatch zone's answer is for another question
+	add(child, newTXT("_redirect.attacker.secure.test.", "v=txtv0;to=https://attacker.test"), inception, expiration)
+
+	// The missing names of secure.test. are denied by NSEC records, the
+	// names that contain "forged" aren't
+	add(child, newNSEC("secure.test.", "nodata.secure.test.", dns.TypeDNSKEY), inception, expiration)
+	add(child, newNSEC("nodata.secure.test.", "z.secure.test.", dns.TypeA), inception, expiration)
+	add(child, newNSEC("_redirect.wildcard.secure.test.", "*.wildcard.secure.test.", dns.TypeTXT), inception, expiration)
+	add(child, newNSEC("*.wildcard.secure.test.", "z.secure.test.", dns.TypeTXT), inception, expiration)
+
+	// The names of hashed.test. are denied by a single NSEC3 record
+	hashed := newSignedZone(t, "hashed.test.")
+	add(parent, hashed.key.ToDS(dns.SHA256), inception, expiration)
+	add(hashed, hashed.key, inception, expiration)
+	apexHash := dns.HashName("hashed.test.", dns.SHA1, 1, "AB")
+	add(hashed, &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: apexHash + ".hashed.test.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+		Hash:       dns.SHA1,
+		Iterations: 1,
+		SaltLength: 1,
+		Salt:       "AB",
+		HashLength: 20,
+		NextDomain: apexHash,
+		TypeBitMap: []uint16{dns.TypeSOA, dns.TypeDNSKEY},
+	}, inception, expiration)
+
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		name := strings.ToLower(q.Name)
+		// Only send the signatures when they're asked for
+		section := func(rrs []dns.RR) []dns.RR {
+			var filtered []dns.RR
+			for _, rr := range rrs {
+				if _, isSig := rr.(*dns.RRSIG); isSig && (r.IsEdns0() == nil || !r.IsEdns0().Do()) {
+					continue
+				}
+				filtered = append(filtered, rr)
+			}
+			return filtered
+		}
+
+		rrs, ok := answers[name+"/"+dns.TypeToString[q.Qtype]]
+		m.Answer = section(rrs)
+		switch {
+		case name == "_redirect.victim.secure.test.":
+			m.Answer = section(answers["_redirect.attacker.secure.test./TXT"])
+		case name == "_redirect.mismatch.secure.test.":
+			m.Question[0].Name = "_redirect.valid.secure.test."
+			m.Answer = section(answers["_redirect.valid.secure.test./TXT"])
+		case ok:
+		case answers[name+"/NSEC"] != nil:
+			m.Ns = section(answers[name+"/NSEC"])
+		case strings.Contains(name, "forged"):
+			m.Rcode = dns.RcodeNameError
+		case strings.HasSuffix(name, ".wildcard.secure.test."):
+			m.Rcode = dns.RcodeNameError
+			m.Ns = section(append(answers["_redirect.wildcard.secure.test./NSEC"], answers["*.wildcard.secure.test./NSEC"]...))
+		case strings.HasSuffix(name, ".secure.test."):
+			m.Rcode = dns.RcodeNameError
+			m.Ns = section(append(answers["secure.test./NSEC"], answers["nodata.secure.test./NSEC"]...))
+		case strings.HasSuffix(name, ".hashed.test."):
+			m.Rcode = dns.RcodeNameError
+			m.Ns = section(answers[strings.ToLower(apexHash)+".hashed.test./NSEC3"])
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+	return addr, parent.key.ToDS(dns.SHA256).String(), shutdown
+}
+
+func Test_queryDNSSEC(t *testing.T) {
+	addr, anchor, shutdown := newDNSSECServer(t)
+	defer shutdown()
+	otherAnchor := newSignedZone(t, "test.").key.ToDS(dns.SHA256).String()
+
+	tests := []struct {
+		zone     string
+		mode     string
+		anchor   string
+		expected string
+		notFound bool
+		err      bool
+	}{
+		{
+			zone:     "_redirect.valid.secure.test.",
+			mode:     DNSSECRequire,
+			anchor:   anchor,
+			expected: "v=txtv0;to=https://valid.test",
+		},
+		{
+			zone:   "_redirect.unsigned.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			zone:     "_redirect.unsigned.secure.test.",
+			mode:     DNSSECPrefer,
+			anchor:   anchor,
+			expected: "v=txtv0;to=https://unsigned.test",
+		},
+		{
+			zone:   "_redirect.bogus.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			zone:     "_redirect.bogus.secure.test.",
+			mode:     DNSSECPrefer,
+			anchor:   anchor,
+			expected: "v=txtv0;to=https://attacker.test",
+		},
+		{
+			zone:   "_redirect.expired.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			// The chain doesn't lead to the configured trust anchor
+			zone:   "_redirect.valid.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: otherAnchor,
+			err:    true,
+		},
+		{
+			// The root anchor is used by default
+			zone: "_redirect.valid.secure.test.",
+			mode: DNSSECRequire,
+			err:  true,
+		},
+		{
+			zone:     "_redirect.missing.secure.test.",
+			mode:     DNSSECRequire,
+			anchor:   anchor,
+			notFound: true,
+		},
+		{
+			zone:     "nodata.secure.test.",
+			mode:     DNSSECRequire,
+			anchor:   anchor,
+			notFound: true,
+		},
+		{
+			zone:     "_redirect.missing.hashed.test.",
+			mode:     DNSSECRequire,
+			anchor:   anchor,
+			notFound: true,
+		},
+		{
+			// The NXDOMAIN answer doesn't have any NSEC records
+			zone:   "_redirect.forged.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			zone:     "_redirect.forged.secure.test.",
+			mode:     DNSSECPrefer,
+			anchor:   anchor,
+			notFound: true,
+		},
+		{
+			// The NSEC records show that the wildcard exists
+			zone:   "_redirect.x.wildcard.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			// The signed records of other names aren't answers
+			zone:   "_redirect.victim.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			zone:     "_redirect.victim.secure.test.",
+			notFound: true,
+		},
+		{
+			zone: "_redirect.mismatch.secure.test.",
+			err:  true,
+		},
+		{
+			zone:   "_redirect.mismatch.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: anchor,
+			err:    true,
+		},
+		{
+			// The denial is only trusted with the right trust anchor
+			zone:   "_redirect.missing.secure.test.",
+			mode:   DNSSECRequire,
+			anchor: otherAnchor,
+			err:    true,
+		},
+	}
+	for i, test := range tests {
+		c := Config{Resolver: addr, DNSSEC: test.mode}
+		if test.anchor != "" {
+			c.TrustAnchors = []string{test.anchor}
+		}
+		txts, err := query(test.zone, context.Background(), c)
+		if test.err {
+			if err == nil || err == ErrNotFound {
+				t.Errorf("Test %d: Expected %s to fail the validation, got %v", i, test.zone, err)
+			}
+			continue
+		}
+		if test.notFound {
+			if err != ErrNotFound {
+				t.Errorf("Test %d: Expected ErrNotFound, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if txts[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txts[0])
+		}
+	}
+}
+
+func TestParseDNSSEC(t *testing.T) {
+	tests := []struct {
+		config string
+		mode   string
+		err    bool
+	}{
+		{
+			config: `resolver 127.0.0.1:53
+			dnssec require
+			trust_anchor . IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D`,
+			mode: DNSSECRequire,
+		},
+		{
+			config: `resolver 127.0.0.1:53
+			dnssec always`,
+			err: true,
+		},
+		{
+			config: `resolver 127.0.0.1:53
+			dnssec prefer
+			trust_anchor example.test. IN TXT "anchor"`,
+			err: true,
+		},
+		{
+			// The system resolver doesn't return the signatures
+			config: `dnssec prefer`,
+			err:    true,
+		},
+	}
+	for i, test := range tests {
+		d := caddyfile.NewTestDispenser("txtdirect {\n" + test.config + "\n}")
+		c, err := ParseCaddy(d)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if c.DNSSEC != test.mode {
+			t.Errorf("Test %d: Expected dnssec to be %s, got %s", i, test.mode, c.DNSSEC)
+		}
+	}
+}
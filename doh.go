@@ -0,0 +1,105 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS messages sent over HTTPS
+const dohMediaType = "application/dns-message"
+
+// dohClient sends the queries to DNS-over-HTTPS resolvers. The queries are
+// limited by their context, so the client doesn't have its own timeout.
+var dohClient = &http.Client{}
+
+// isDoH checks if the given resolver is a DNS-over-HTTPS endpoint
+func isDoH(resolver string) bool {
+	return strings.HasPrefix(resolver, "https://")
+}
+
+// exchangeHTTPS sends the message to the DNS-over-HTTPS resolver as described
+// in RFC 8484. The GET or POST method is used depending on the config.
+func exchangeHTTPS(ctx context.Context, m *dns.Msg, c Config) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+
+	// Use 0 as the message ID to make the responses cacheable by HTTP caches
+	msg := m.Copy()
+	msg.Id = 0
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	switch strings.ToUpper(c.DoHMethod) {
+	case http.MethodGet:
+		endpoint, err := url.Parse(c.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		query := endpoint.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+		endpoint.RawQuery = query.Encode()
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil); err != nil {
+			return nil, err
+		}
+	case http.MethodPost, "":
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.Resolver, bytes.NewReader(wire)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", dohMediaType)
+	default:
+		return nil, fmt.Errorf("unsupported DNS-over-HTTPS method %s", c.DoHMethod)
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS resolver responded with %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), dohMediaType) {
+		return nil, fmt.Errorf("DNS-over-HTTPS resolver responded with %s content", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
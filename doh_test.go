@@ -0,0 +1,157 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newDoHServer returns a DNS-over-HTTPS stand-in that answers
+// the TXT queries using the given zone map
+func newDoHServer(t *testing.T, zones map[string]string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(wire); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			t.Errorf("Expected the DoH query ID to be 0, got %d", req.Id)
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for _, q := range req.Question {
+			txt, ok := zones[q.Name]
+			if !ok {
+				m.Rcode = dns.RcodeNameError
+				continue
+			}
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{txt},
+			})
+		}
+
+		resp, err := m.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(resp)
+	}))
+}
+
+func Test_queryDoH(t *testing.T) {
+	ts := newDoHServer(t, txts)
+	defer ts.Close()
+
+	client := dohClient
+	dohClient = ts.Client()
+	defer func() { dohClient = client }()
+
+	tests := []struct {
+		zone   string
+		method string
+		err    error
+	}{
+		{
+			zone:   "_redirect.about.host.host.example.com.",
+			method: "",
+		},
+		{
+			zone:   "_redirect.about.host.host.example.com.",
+			method: http.MethodGet,
+		},
+		{
+			zone:   "_redirect.pkg.gometa.gometa.example.com.",
+			method: http.MethodPost,
+		},
+		{
+			zone:   "_redirect.missing.example.com.",
+			method: http.MethodGet,
+			err:    ErrNotFound,
+		},
+		{
+			zone:   "_redirect.missing.example.com.",
+			method: http.MethodPost,
+			err:    ErrNotFound,
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver:  ts.URL + "/dns-query",
+			DoHMethod: test.method,
+		}
+		resp, err := query(test.zone, context.Background(), c)
+		if err != test.err {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if resp[0] != txts[test.zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[test.zone], resp[0])
+		}
+	}
+}
+
+func Test_exchangeHTTPSErrors(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text" {
+			w.Write([]byte("not a DNS message"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	client := dohClient
+	dohClient = ts.Client()
+	defer func() { dohClient = client }()
+
+	for _, endpoint := range []string{"/dns-query", "/text"} {
+		m := new(dns.Msg)
+		m.SetQuestion("_redirect.example.com.", dns.TypeTXT)
+		if _, err := exchangeHTTPS(context.Background(), m, Config{Resolver: ts.URL + endpoint}); err == nil {
+			t.Errorf("Expected an error from %s", endpoint)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	dotScheme      = "tls://"
+	defaultDoTPort = "853"
+)
+
+// caPools keeps the loaded CA bundles by their path
+var caPools sync.Map
+
+// isDoT checks if the given resolver is a DNS-over-TLS server
+func isDoT(resolver string) bool {
+	return strings.HasPrefix(resolver, dotScheme)
+}
+
+// dotAddress returns the host:port address of the DNS-over-TLS resolver
+func dotAddress(resolver string) string {
+	addr := strings.TrimPrefix(resolver, dotScheme)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, defaultDoTPort)
+	}
+	return addr
+}
+
+// dialTLS opens a DNS-over-TLS connection to the resolver as described
+// in RFC 7858 and verifies the server's certificate
+func dialTLS(ctx context.Context, d *net.Dialer, c Config) (net.Conn, error) {
+	config, err := resolverTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", dotAddress(c.Resolver))
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// resolverTLSConfig returns the TLS config used for the DNS-over-TLS
+// resolver. The system roots are used if no CA bundle is configured.
+func resolverTLSConfig(c Config) (*tls.Config, error) {
+	serverName := c.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(dotAddress(c.Resolver))
+	}
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.TLSCA != "" {
+		pool, err := loadCAPool(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// loadCAPool loads the PEM encoded certificates from the given file
+func loadCAPool(path string) (*x509.CertPool, error) {
+	if pool, ok := caPools.Load(path); ok {
+		return pool.(*x509.CertPool), nil
+	}
+
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the CA bundle: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("couldn't find any certificates in %s", path)
+	}
+	caPools.Store(path, pool)
+	return pool, nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCertificate generates a self-signed certificate for 127.0.0.1
+// and dns.example.test and returns it with its PEM encoding
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"dns.example.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newDoTServer starts a DNS-over-TLS server that answers using the testing
+// zone and returns its address
+func newDoTServer(t *testing.T, cert tls.Certificate) (string, func()) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          ln,
+		Net:               "tcp-tls",
+		Handler:           dns.HandlerFunc(handleDNSRequest),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return ln.Addr().String(), func() { srv.Shutdown() }
+}
+
+func Test_queryDoT(t *testing.T) {
+	cert, caPEM := newTestCertificate(t)
+	addr, shutdown := newDoTServer(t, cert)
+	defer shutdown()
+
+	caFile, err := ioutil.TempFile("", "txtdirect-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	caFile.Write(caPEM)
+	caFile.Close()
+
+	tests := []struct {
+		serverName string
+		ca         string
+		err        bool
+	}{
+		{
+			ca: caFile.Name(),
+		},
+		{
+			serverName: "dns.example.test",
+			ca:         caFile.Name(),
+		},
+		{
+			serverName: "wrong.example.test",
+			ca:         caFile.Name(),
+			err:        true,
+		},
+		{
+			// The testing certificate isn't trusted by the system roots
+			err: true,
+		},
+	}
+	zone := "_redirect.about.host.host.example.com."
+	for i, test := range tests {
+		c := Config{
+			Resolver:      "tls://" + addr,
+			TLSServerName: test.serverName,
+			TLSCA:         test.ca,
+		}
+		resp, err := query(zone, context.Background(), c)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected the certificate verification to fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != txts[zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[zone], resp[0])
+		}
+	}
+}
+
+func Test_dotAddress(t *testing.T) {
+	tests := []struct {
+		resolver string
+		expected string
+	}{
+		{"tls://1.1.1.1", "1.1.1.1:853"},
+		{"tls://1.1.1.1:8853", "1.1.1.1:8853"},
+		{"tls://dns.example.test", "dns.example.test:853"},
+		{"tls://[2606:4700:4700::1111]:853", "[2606:4700:4700::1111]:853"},
+	}
+	for _, test := range tests {
+		if addr := dotAddress(test.resolver); addr != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, addr)
+		}
+	}
+}
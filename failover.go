@@ -0,0 +1,218 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies used to pick the resolver when more than one is configured
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "round_robin"
+	StrategyRace       = "race"
+)
+
+const (
+	// healthFailures is the number of consecutive failures
+	// after which a resolver is considered unhealthy
+	healthFailures = 3
+	// healthBackoff is how long an unhealthy resolver is skipped
+	healthBackoff = 30 * time.Second
+)
+
+var (
+	healthMu sync.Mutex
+	health   = map[string]*resolverHealth{}
+
+	// roundRobin is the index of the next resolver used by round_robin
+	roundRobin uint32
+)
+
+// resolverHealth keeps the recent failures of a resolver
+type resolverHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+// resolvers returns the custom resolvers set in the config
+func (c Config) resolvers() []string {
+	if len(c.Resolvers) != 0 {
+		return c.Resolvers
+	}
+	if c.Resolver != "" {
+		return []string{c.Resolver}
+	}
+	return nil
+}
+
+// exchangeResolvers sends the message to the configured resolvers using
+// the configured strategy. A resolver failure only triggers the next
+// resolver, missing records are valid answers.
+func exchangeResolvers(ctx context.Context, m *dns.Msg, c Config) (*dns.Msg, error) {
+	resolvers := orderResolvers(c)
+
+	if c.ResolverStrategy == StrategyRace && len(resolvers) > 1 {
+		return raceResolvers(ctx, m, c, resolvers)
+	}
+
+	var err error
+	for i, resolver := range resolvers {
+		var resp *dns.Msg
+		timeout := resolverTimeout(ctx, c, len(resolvers)-i)
+		if resp, err = exchangeWith(ctx, m, c, resolver, timeout); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("[txtdirect]: Resolver %s failed: %s", resolver, err.Error())
+	}
+	return nil, err
+}
+
+// raceResolvers sends the message to all of the resolvers at the same
+// time and returns the first successful response
+func raceResolvers(ctx context.Context, m *dns.Msg, c Config, resolvers []string) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(resolvers))
+	for _, resolver := range resolvers {
+		go func(resolver string) {
+			resp, err := exchangeWith(ctx, m.Copy(), c, resolver, c.ResolverTimeout)
+			results <- result{resp, err}
+		}(resolver)
+	}
+
+	var err error
+	for range resolvers {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		err = r.err
+	}
+	return nil, err
+}
+
+// resolverTimeout returns the time limit of a resolver when the given
+// number of resolvers are left to try. Unless resolver_timeout is set, the
+// remaining time of the query is shared by the resolvers, so a resolver
+// that doesn't answer can't use it up.
+func resolverTimeout(ctx context.Context, c Config, left int) time.Duration {
+	if c.ResolverTimeout > 0 || left <= 1 {
+		return c.ResolverTimeout
+	}
+	remaining := c.queryTimeout()
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining = time.Until(deadline)
+	}
+	return remaining / time.Duration(left)
+}
+
+// exchangeWith sends the message to the given resolver using the given
+// timeout and updates the resolver's health. The resolver's timeouts
+// count as failures too.
+func exchangeWith(ctx context.Context, m *dns.Msg, c Config, resolver string, timeout time.Duration) (*dns.Msg, error) {
+	rc := c
+	rc.Resolver = resolver
+	rc.Resolvers = nil
+
+	queryCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, err := exchange(queryCtx, m, rc)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("%s responded with %s", resolver, dns.RcodeToString[resp.Rcode])
+	}
+
+	// Don't blame the resolver when the lookup itself got canceled
+	if ctx.Err() == nil {
+		reportHealth(resolver, err == nil)
+	}
+	return resp, err
+}
+
+// orderResolvers returns the healthy resolvers in the order they should be
+// tried. Unhealthy resolvers are only used when no healthy one is left.
+func orderResolvers(c Config) []string {
+	resolvers := c.resolvers()
+	if c.ResolverStrategy == StrategyRoundRobin && len(resolvers) > 1 {
+		start := int(atomic.AddUint32(&roundRobin, 1) % uint32(len(resolvers)))
+		resolvers = append(append([]string{}, resolvers[start:]...), resolvers[:start]...)
+	}
+
+	var healthy, unhealthy []string
+	for _, resolver := range resolvers {
+		if resolverHealthy(resolver) {
+			healthy = append(healthy, resolver)
+		} else {
+			unhealthy = append(unhealthy, resolver)
+		}
+	}
+	if len(healthy) == 0 {
+		return unhealthy
+	}
+	return healthy
+}
+
+// resolverHealthy checks if the resolver is currently considered healthy
+func resolverHealthy(resolver string) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, ok := health[resolver]
+	return !ok || time.Now().After(h.downUntil)
+}
+
+// reportHealth records the result of a query sent to the given resolver
+func reportHealth(resolver string, ok bool) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	h, found := health[resolver]
+	if !found {
+		if ok {
+			return
+		}
+		h = &resolverHealth{}
+		health[resolver] = h
+	}
+	if ok {
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	if h.failures >= healthFailures {
+		log.Printf("[txtdirect]: Resolver %s failed %d times in a row, skipping it for %s", resolver, h.failures, healthBackoff)
+		h.downUntil = time.Now().Add(healthBackoff)
+		h.failures = 0
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingHandler answers using the testing zone and counts the queries
+func countingHandler(count *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(count, 1)
+		handleDNSRequest(w, r)
+	}
+}
+
+// failingHandler answers every query with SERVFAIL and counts the queries
+func failingHandler(count *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(count, 1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}
+}
+
+// newBlackhole returns the address of a resolver that never answers
+func newBlackhole(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+func TestResolverStrategies(t *testing.T) {
+	var goodQueries, otherQueries, failedQueries int32
+	good, shutdown := newTestDNSServer(t, countingHandler(&goodQueries))
+	defer shutdown()
+	other, shutdown := newTestDNSServer(t, countingHandler(&otherQueries))
+	defer shutdown()
+	failing, shutdown := newTestDNSServer(t, failingHandler(&failedQueries))
+	defer shutdown()
+	blackhole, closeBlackhole := newBlackhole(t)
+	defer closeBlackhole()
+
+	tests := []struct {
+		resolvers []string
+		strategy  string
+		timeout   time.Duration
+		err       bool
+	}{
+		{
+			resolvers: []string{failing, good},
+		},
+		{
+			resolvers: []string{failing, good},
+			strategy:  StrategyFailover,
+		},
+		{
+			resolvers: []string{blackhole, good},
+			strategy:  StrategyFailover,
+			timeout:   100 * time.Millisecond,
+		},
+		{
+			resolvers: []string{blackhole, good},
+			strategy:  StrategyRace,
+		},
+		{
+			resolvers: []string{blackhole, failing, good},
+			strategy:  StrategyRoundRobin,
+			timeout:   100 * time.Millisecond,
+		},
+		{
+			resolvers: []string{failing, blackhole},
+			strategy:  StrategyRace,
+			timeout:   100 * time.Millisecond,
+			err:       true,
+		},
+	}
+	zone := "_redirect.about.host.host.example.com."
+	for i, test := range tests {
+		c := Config{
+			Resolvers:        test.resolvers,
+			ResolverStrategy: test.strategy,
+			ResolverTimeout:  test.timeout,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		resp, err := query(zone, ctx, c)
+		cancel()
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected all of the resolvers to fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != txts[zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[zone], resp[0])
+		}
+	}
+
+	// Round robin should spread the queries between the resolvers
+	atomic.StoreInt32(&goodQueries, 0)
+	atomic.StoreInt32(&otherQueries, 0)
+	c := Config{
+		Resolvers:        []string{good, other},
+		ResolverStrategy: StrategyRoundRobin,
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := query(zone, context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&goodQueries) != 2 || atomic.LoadInt32(&otherQueries) != 2 {
+		t.Errorf("Expected the queries to be spread evenly, got %d and %d", goodQueries, otherQueries)
+	}
+}
+
+func TestResolverHealth(t *testing.T) {
+	var goodQueries, failedQueries int32
+	good, shutdown := newTestDNSServer(t, countingHandler(&goodQueries))
+	defer shutdown()
+	failing, shutdown := newTestDNSServer(t, failingHandler(&failedQueries))
+	defer shutdown()
+
+	c := Config{
+		Resolvers: []string{failing, good},
+	}
+	zone := "_redirect.about.host.host.example.com."
+	for i := 0; i < 10; i++ {
+		if _, err := query(zone, context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&failedQueries) != healthFailures {
+		t.Errorf("Expected the failing resolver to be skipped after %d failures, got %d queries", healthFailures, failedQueries)
+	}
+	if atomic.LoadInt32(&goodQueries) != 10 {
+		t.Errorf("Expected all of the queries to be answered by the healthy resolver, got %d", goodQueries)
+	}
+	if resolverHealthy(failing) {
+		t.Errorf("Expected %s to be unhealthy", failing)
+	}
+
+	// Unhealthy resolvers are still used when there's no other option
+	c.Resolvers = []string{failing}
+	query(zone, context.Background(), c)
+	if atomic.LoadInt32(&failedQueries) != healthFailures+1 {
+		t.Errorf("Expected the unhealthy resolver to be used as the last resort")
+	}
+}
+
+func TestResolverTimeoutShare(t *testing.T) {
+	var goodQueries int32
+	good, shutdown := newTestDNSServer(t, countingHandler(&goodQueries))
+	defer shutdown()
+	blackhole, closeBlackhole := newBlackhole(t)
+	defer closeBlackhole()
+
+	// Without resolver_timeout the resolvers share the query timeout
+	c := Config{
+		Resolvers:        []string{blackhole, good},
+		ResolverStrategy: StrategyFailover,
+		QueryTimeout:     200 * time.Millisecond,
+	}
+	zone := "_redirect.about.host.host.example.com."
+	for i := 0; i < healthFailures; i++ {
+		if _, err := query(zone, context.Background(), c); err != nil {
+			t.Fatalf("Query %d: Expected the next resolver to answer, got %s", i, err)
+		}
+	}
+
+	if atomic.LoadInt32(&goodQueries) != healthFailures {
+		t.Errorf("Expected %d queries to be answered by the healthy resolver, got %d", healthFailures, goodQueries)
+	}
+	if resolverHealthy(blackhole) {
+		t.Errorf("Expected the timeouts to mark %s unhealthy", blackhole)
+	}
+}
@@ -6,5 +6,6 @@ require (
 	github.com/caddyserver/caddy/v2 v2.1.1
 	github.com/miekg/dns v1.1.27
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
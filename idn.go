@@ -0,0 +1,131 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	maxLabelLength = 63
+
+	// encodedLabelPrefix marks the path labels that contain the
+	// base32hex encoding of the path segment
+	encodedLabelPrefix = "x--"
+	// hashedLabelPrefix marks the path labels that contain the base32hex
+	// encoding of the segment's SHA-256 hash, used for the long segments
+	hashedLabelPrefix = "y--"
+)
+
+// idnaProfile maps the Unicode labels for the lookups as described in UTS #46
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.VerifyDNSLength(true),
+)
+
+var labelEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// asciiZone converts the Unicode labels of the given zone to punycode.
+// ASCII labels such as _redirect are only lowercased, so the case variants
+// of a host share the same cache entry.
+func asciiZone(zone string) string {
+	labels := strings.Split(zone, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		if ascii, err := idnaProfile.ToASCII(label); err == nil {
+			labels[i] = ascii
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// EncodePathLabel returns the DNS label used in the path zones for the
+// given path segment. Tools that generate the records can use it to get
+// the same zones:
+//   - Segments of letters, digits, hyphens, underscores and dots are used as
+//     they are, with dots replaced by hyphens
+//   - Unicode segments are converted to punycode with UTS #46, e.g. "café"
+//     becomes "xn--caf-dma"
+//   - Other segments, and the ones that would start with the reserved "x--"
+//     and "y--" prefixes, are encoded as "x--" followed by the lowercase
+//     unpadded base32hex encoding of the segment's UTF-8 bytes
+//   - Labels that would be longer than 63 characters are replaced by "y--"
+//     followed by the lowercase unpadded base32hex encoding of the segment's
+//     SHA-256 hash
+func EncodePathLabel(segment string) string {
+	label := strings.Replace(segment, ".", "-", -1)
+	encode := false
+	if isASCII(label) {
+		encode = !isLDHLabel(label) || hasReservedPrefix(label)
+	} else if ascii, err := idnaProfile.ToASCII(label); err == nil && !strings.Contains(ascii, ".") {
+		label = ascii
+	} else {
+		encode = true
+	}
+	if encode {
+		label = encodedLabelPrefix + strings.ToLower(labelEncoding.EncodeToString([]byte(segment)))
+	}
+	if len(label) > maxLabelLength {
+		hash := sha256.Sum256([]byte(segment))
+		label = hashedLabelPrefix + strings.ToLower(labelEncoding.EncodeToString(hash[:]))
+	}
+	return label
+}
+
+// encodePathLabels returns the DNS labels of the given path segments
+func encodePathLabels(segments []string) []string {
+	labels := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		labels = append(labels, EncodePathLabel(segment))
+	}
+	return labels
+}
+
+// isLDHLabel checks if the label only has letters, digits, hyphens
+// and underscores
+func isLDHLabel(label string) bool {
+	for i := 0; i < len(label); i++ {
+		b := label[i]
+		if !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-' || b == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// hasReservedPrefix checks if the label starts with one of the prefixes of
+// the encoded labels, so a segment can't collide with another's encoding
+func hasReservedPrefix(label string) bool {
+	label = strings.ToLower(label)
+	return strings.HasPrefix(label, encodedLabelPrefix) || strings.HasPrefix(label, hashedLabelPrefix)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodePathLabel(t *testing.T) {
+	tests := []struct {
+		segment  string
+		expected string
+	}{
+		{
+			segment:  "docs",
+			expected: "docs",
+		},
+		{
+			segment:  "v1.2",
+			expected: "v1-2",
+		},
+		{
+			segment:  "café",
+			expected: "xn--caf-dma",
+		},
+		{
+			segment:  "CAFÉ",
+			expected: "xn--caf-dma",
+		},
+		{
+			// Not a valid IDNA label
+			segment:  "café!",
+			expected: "x--cdgmdgt944",
+		},
+		{
+			// Not a valid DNS label
+			segment:  "cafe!",
+			expected: "x--cdgmcp91",
+		},
+		{
+			segment:  "a@b",
+			expected: "x--c5064",
+		},
+		{
+			segment:  "x(1)",
+			expected: "x--f0k32a8",
+		},
+		{
+			segment:  "a+b",
+			expected: "x--c4lm4",
+		},
+		{
+			segment:  "docs_v2",
+			expected: "docs_v2",
+		},
+		{
+			// Shouldn't collide with the encoded segments
+			segment:  "x--abc",
+			expected: "x--f0miqob2cc",
+		},
+		{
+			segment:  "Y--abc",
+			expected: "x--b4miqob2cc",
+		},
+		{
+			segment:  "x..y",
+			expected: "x--f0n2su8",
+		},
+		{
+			segment:  strings.Repeat("a", 70),
+			expected: "y--dfaua0q8amgh4gfgrrkfosk51vupildigd3qgp18mnt1i4cvdb80",
+		},
+	}
+	for i, test := range tests {
+		if label := EncodePathLabel(test.segment); label != test.expected {
+			t.Errorf("Test %d: Expected %s to be encoded as %s, got %s", i, test.segment, test.expected, label)
+		}
+	}
+}
+
+func Test_absoluteZoneIDN(t *testing.T) {
+	tests := []struct {
+		zone     string
+		expected string
+	}{
+		{
+			zone:     "bücher.example.test",
+			expected: "_redirect.xn--bcher-kva.example.test.",
+		},
+		{
+			zone:     "BÜCHER.example.test:8080",
+			expected: "_redirect.xn--bcher-kva.example.test.",
+		},
+		{
+			zone:     "xn--bcher-kva.example.test",
+			expected: "_redirect.xn--bcher-kva.example.test.",
+		},
+		{
+			zone:     "_.bücher.example.test",
+			expected: "_redirect._.xn--bcher-kva.example.test.",
+		},
+		{
+			zone:     "Example.TEST",
+			expected: "_redirect.example.test.",
+		},
+		{
+			zone:     "XN--BCHER-KVA.Example.test",
+			expected: "_redirect.xn--bcher-kva.example.test.",
+		},
+	}
+	for i, test := range tests {
+		if zone := absoluteZone(test.zone, Config{}); zone != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, zone)
+		}
+	}
+}
+
+func TestRedirectIDN(t *testing.T) {
+	source := mapSource{
+		"_redirect.xn--bcher-kva.example.test.":                    {"v=txtv0;to=https://books.target.test;type=host"},
+		"_redirect.path.xn--bcher-kva.example.test.":               {"v=txtv0;type=path"},
+		"_redirect.xn--caf-dma.path.xn--bcher-kva.example.test.":   {"v=txtv0;to=https://cafe.target.test;type=host"},
+		"_redirect.x--cdgmdgt944.path.xn--bcher-kva.example.test.": {"v=txtv0;to=https://encoded.target.test;type=host"},
+	}
+	tests := []struct {
+		url      string
+		location string
+	}{
+		{
+			url:      "https://xn--bcher-kva.example.test",
+			location: "https://books.target.test",
+		},
+		{
+			url:      "https://path.xn--bcher-kva.example.test/caf%C3%A9",
+			location: "https://cafe.target.test",
+		},
+		{
+			url:      "https://path.xn--bcher-kva.example.test/caf%C3%A9!",
+			location: "https://encoded.target.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Enable:   []string{"host", "path"},
+			Redirect: "https://fallback.test",
+			Source:   source,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+	}
+
+	// Unicode Host headers are converted before the lookup
+	req := httptest.NewRequest("GET", "https://example.test", nil)
+	req.Host = "bücher.example.test"
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, Config{Enable: []string{"host"}, Source: source}); err != nil {
+		t.Fatal(err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://books.target.test" {
+		t.Errorf("Expected the Unicode host to be redirected, got %s", location)
+	}
+}
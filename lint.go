@@ -0,0 +1,164 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LintResult is a TXTDirect record of the zone files and its problems
+type LintResult struct {
+	// File is only set for the zone files that couldn't be parsed
+	File string
+	// Zone is the owner name of the record, e.g. _redirect.example.com.
+	Zone string
+	// TXT is empty if the TXTDirect record of the zone couldn't be selected
+	TXT      string
+	Record   Record
+	Problems []Problem
+}
+
+// LintZoneFiles validates every TXTDirect record of the given zone files
+// and returns the results sorted by zone. Besides the problems of each
+// record, it checks the records against each other and treats the zone
+// files as the complete set of records: the zones used by use= fields and
+// the children of path records must exist. The zone files that can't be
+// parsed are reported first and their records are skipped.
+func LintZoneFiles(zones []ZoneFile, c Config) ([]LintResult, error) {
+	var results []LintResult
+	files := make(map[string]*fileRecords)
+	for _, zone := range zones {
+		f, err := os.Open(zone.Path)
+		if err != nil {
+			return nil, err
+		}
+		records := make(map[string]*fileRecords)
+		err = parseZoneFile(f, zone, records)
+		f.Close()
+		if err != nil {
+			results = append(results, LintResult{
+				File:     zone.Path,
+				Problems: []Problem{errorProblem(ProblemInvalidZoneFile, "", "%s", err.Error())},
+			})
+			continue
+		}
+		for name, rec := range records {
+			if _, ok := files[name]; !ok {
+				files[name] = &fileRecords{}
+			}
+			files[name].txts = append(files[name].txts, rec.txts...)
+		}
+	}
+
+	prefix := c.baseZone() + "."
+	var names []string
+	for name := range files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result := LintResult{Zone: name}
+		txt, err := selectRecord(name, files[name].txts)
+		if err != nil {
+			code := ProblemMissingRecord
+			if isConflict(err) {
+				code = ProblemConflictingRecords
+			}
+			result.Problems = []Problem{errorProblem(code, "", "%s", err.Error())}
+			results = append(results, result)
+			continue
+		}
+		result.TXT = txt
+		result.Record, result.Problems = ValidateRecord(txt, c)
+		result.Problems = append(result.Problems, lintRecord(name, result.Record, files, prefix)...)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// lintRecord checks the record of the given zone against the other names
+// of the zone files
+func lintRecord(zone string, rec Record, files map[string]*fileRecords, prefix string) []Problem {
+	var problems []Problem
+
+	for _, use := range rec.Use {
+		if _, ok := files[strings.ToLower(dns.Fqdn(use))]; !ok {
+			problems = append(problems, errorProblem(ProblemMissingUse, "use", "%s doesn't exist in the zone files", use))
+		}
+	}
+
+	if rec.Type != "path" || len(rec.Use) != 0 {
+		return problems
+	}
+
+	// The children of _redirect.example.com. are _redirect.*.example.com.
+	host := strings.TrimPrefix(zone, prefix)
+	child := func(label string) bool {
+		_, ok := files[prefix+label+"."+host]
+		return ok
+	}
+
+	if rec.Re == "record" {
+		if len(rec.Index) > 0 {
+			for _, label := range rec.Index {
+				if !child(label) {
+					problems = append(problems, errorProblem(ProblemMissingSubzone, "index", "the %s subzone listed in the index doesn't exist", label))
+				}
+			}
+			if next := numberedIndex(rec.Index); next != "" && child(next) {
+				problems = append(problems, errorProblem(ProblemExtraSubzone, "index", "the index lists %d subzones but the %s subzone exists too", len(rec.Index), next))
+			}
+			return problems
+		}
+
+		if !child("1") {
+			return append(problems, errorProblem(ProblemMissingSubzone, "re", "the predefined regex record 1.%s doesn't exist", host))
+		}
+		// Numbered subzones after a missing one are never used
+		last := 1
+		for child(strconv.Itoa(last + 1)) {
+			last++
+		}
+		var unreachable []int
+		for name := range files {
+			if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, "."+host) {
+				continue
+			}
+			label := strings.TrimSuffix(strings.TrimPrefix(name, prefix), "."+host)
+			if n, err := strconv.Atoi(label); err == nil && n > last+1 {
+				unreachable = append(unreachable, n)
+			}
+		}
+		sort.Ints(unreachable)
+		for _, n := range unreachable {
+			problems = append(problems, warningProblem(ProblemUnreachableSubzone, "re", "the predefined regex record %d.%s is unreachable after the missing %d.%s", n, host, last+1, host))
+		}
+		return problems
+	}
+
+	for name := range files {
+		if name != zone && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "."+host) {
+			return problems
+		}
+	}
+	return append(problems, warningProblem(ProblemNoChildren, "type", "the path record doesn't have any child records"))
+}
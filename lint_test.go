@@ -0,0 +1,120 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const lintZone = `$TTL 1h
+_redirect.host              IN TXT "v=txtv1;to=https://host.target.test"
+_redirect.nochildren        IN TXT "v=txtv1;type=path;to=https://fallback.target.test"
+_redirect.path              IN TXT "v=txtv1;type=path;to=https://fallback.target.test"
+_redirect.docs.path         IN TXT "v=txtv1;to=https://docs.target.test"
+_redirect.regex             IN TXT "v=txtv1;type=path;re=record"
+_redirect.1.regex           IN TXT "v=txtv1;re=^/a$;to=https://a.target.test"
+_redirect.3.regex           IN TXT "v=txtv1;re=^/c$;to=https://c.target.test"
+_redirect.indexed           IN TXT "v=txtv1;type=path;re=record;index=2"
+_redirect.1.indexed         IN TXT "v=txtv1;re=^/a$;to=https://a.target.test"
+_redirect.3.indexed         IN TXT "v=txtv1;re=^/c$;to=https://c.target.test"
+_redirect.noregex           IN TXT "v=txtv1;type=path;re=record"
+_redirect.refrom            IN TXT "v=txtv1;type=path;re=^/(.*)$;from=/$1"
+_redirect.child.refrom      IN TXT "v=txtv1;to=https://child.target.test"
+_redirect.upstream          IN TXT "v=txtv1;use=_redirect.host.lint.test;use=_redirect.missing.lint.test"
+_redirect.unknown           IN TXT "v=txtv0;to=https://unknown.target.test;key=value"
+_redirect.strict            IN TXT "v=txtv1;to=https://strict.target.test;key=value"
+_redirect.gometa            IN TXT "v=txtv1;type=gometa;to=https://github.com/example/pkg"
+_redirect.conflict          IN TXT "v=txtv1;to=https://a.target.test"
+_redirect.conflict          IN TXT "v=txtv1;to=https://b.target.test"
+other                       IN TXT "not a TXTDirect record"
+`
+
+func TestLintZoneFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "txtdirect-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(lintZone); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Other files next to the zone files are reported without stopping the lint
+	readme, err := ioutil.TempFile("", "txtdirect-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(readme.Name())
+	if _, err := readme.WriteString("# Zone files\n\nThe records of lint.test.\n"); err != nil {
+		t.Fatal(err)
+	}
+	readme.Close()
+
+	c := Config{Enable: []string{"host", "path"}}
+	zones := []ZoneFile{{Path: readme.Name(), Origin: "lint.test"}, {Path: f.Name(), Origin: "lint.test"}}
+	results, err := LintZoneFiles(zones, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 19 {
+		t.Fatalf("Expected the README and the 18 TXTDirect records, got %d", len(results))
+	}
+	if results[0].File != readme.Name() || len(results[0].Problems) != 1 || results[0].Problems[0].Code != ProblemInvalidZoneFile {
+		t.Errorf("Expected the README to be reported, got %+v", results[0])
+	}
+	results = results[1:]
+
+	type issue struct {
+		zone string
+		Problem
+	}
+	var issues []issue
+	for _, result := range results {
+		for _, problem := range result.Problems {
+			issues = append(issues, issue{result.Zone, problem})
+		}
+		if result.Zone == "_redirect.host.lint.test." && result.Record.To != "https://host.target.test" {
+			t.Errorf("Unexpected record for %s: %+v", result.Zone, result.Record)
+		}
+	}
+
+	expected := []issue{
+		{"_redirect.conflict.lint.test.", Problem{SeverityError, ProblemConflictingRecords, "", `_redirect.conflict.lint.test. has 2 conflicting TXTDirect records: ["v=txtv1;to=https://a.target.test" "v=txtv1;to=https://b.target.test"]`}},
+		{"_redirect.gometa.lint.test.", Problem{SeverityError, ProblemTypeNotEnabled, "type", "gometa type is not enabled in configuration"}},
+		{"_redirect.indexed.lint.test.", Problem{SeverityError, ProblemMissingSubzone, "index", "the 2 subzone listed in the index doesn't exist"}},
+		{"_redirect.indexed.lint.test.", Problem{SeverityError, ProblemExtraSubzone, "index", "the index lists 2 subzones but the 3 subzone exists too"}},
+		{"_redirect.nochildren.lint.test.", Problem{SeverityWarning, ProblemNoChildren, "type", "the path record doesn't have any child records"}},
+		{"_redirect.noregex.lint.test.", Problem{SeverityError, ProblemMissingSubzone, "re", "the predefined regex record 1.noregex.lint.test. doesn't exist"}},
+		{"_redirect.refrom.lint.test.", Problem{SeverityError, ProblemRegexWithFrom, "from", "from= field can't be used together with re="}},
+		{"_redirect.regex.lint.test.", Problem{SeverityWarning, ProblemUnreachableSubzone, "re", "the predefined regex record 3.regex.lint.test. is unreachable after the missing 2.regex.lint.test."}},
+		{"_redirect.strict.lint.test.", Problem{SeverityError, ProblemUnknownField, "key", "unknown field key"}},
+		{"_redirect.unknown.lint.test.", Problem{SeverityWarning, ProblemUnknownField, "key", "unknown field key is ignored"}},
+		{"_redirect.unknown.lint.test.", Problem{SeverityWarning, ProblemDeprecatedVersion, "v", "txtv0 is not suitable for production"}},
+		{"_redirect.upstream.lint.test.", Problem{SeverityError, ProblemMissingUse, "use", "_redirect.missing.lint.test doesn't exist in the zone files"}},
+	}
+	if !reflect.DeepEqual(issues, expected) {
+		t.Errorf("Unexpected issues:")
+		for _, issue := range issues {
+			t.Log(issue.zone, issue.Problem)
+		}
+	}
+
+	if _, err := LintZoneFiles([]ZoneFile{{Path: "e2e/missing/zonefile"}}, c); err == nil {
+		t.Error("Expected a missing zone file to fail")
+	}
+}
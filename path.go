@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -45,7 +46,7 @@ type RegexRecord struct {
 
 // PathRegex is the default regex to parse request's path
 // It can be replaced using the re= field in the records
-var PathRegex = regexp.MustCompile("\\/([A-Za-z0-9-._~!$'()*+,;=:@]+)")
+var PathRegex = regexp.MustCompile("\\/([A-Za-z0-9-._~!$'()*+,;=:@\\x{80}-\\x{10FFFF}]+)")
 
 // FromRegex parses the from= field
 var FromRegex = regexp.MustCompile("\\/\\$(\\d+)")
@@ -69,7 +70,12 @@ func NewPath(w http.ResponseWriter, r *http.Request, path string, rec Record, c
 
 // Redirect finds and returns the final record
 func (p *Path) Redirect() *Record {
-	zone, from, pathSlice, err := zoneFromPath(p.req, p.rec)
+	zone, from, pathSlice, err := zoneFromPath(p.req, p.rec, p.c)
+	if err != nil {
+		log.Print("Fallback is triggered because an error has occurred: ", err)
+		fallback(p.rw, p.req, "to", p.rec.Code, p.c)
+		return nil
+	}
 	rec, err := getFinalRecord(zone, from, p.c, p.rw, p.req, pathSlice)
 	*p.req = *rec.addToContext(p.req)
 	if err != nil {
@@ -134,7 +140,7 @@ func (p *Path) specificMatch(regexes []RegexRecord) (*Record, error) {
 	// Run each regex on the path and list them in a map
 	for _, zone := range regexes {
 		// Compile the regex and find the path submatches
-		regex, err := regexp.Compile(zone.Regex)
+		regex, err := compileRegex(zone.Regex)
 		if err != nil {
 			return nil, fmt.Errorf("Couldn't compile the regex: %s", err.Error())
 		}
@@ -165,42 +171,134 @@ func (p *Path) specificMatch(regexes []RegexRecord) (*Record, error) {
 	return &rec, nil
 }
 
+// regexBatchSize limits how many predefined regex subzones are queried
+// concurrently
+const regexBatchSize = 8
+
+// regexLookup holds the result of a single predefined regex subzone query
+type regexLookup struct {
+	txt string
+	err error
+}
+
+// fetchRegexes returns the predefined regex records in order. The subzones
+// listed in the record's index= field are fetched when it's set, otherwise
+// the numbered subzones are queried in concurrent batches until the first
+// missing one.
 func (p *Path) fetchRegexes() ([]RegexRecord, error) {
+	if len(p.rec.Index) > 0 {
+		return p.fetchIndexedRegexes()
+	}
+
+	batchSize := p.regexBatchSize()
+	regexes := []RegexRecord{}
+	for start := 1; ; start += batchSize {
+		labels := make([]string, batchSize)
+		for i := range labels {
+			labels[i] = strconv.Itoa(start + i)
+		}
+
+		for i, lookup := range p.lookupRegexes(labels) {
+			if lookup.err != nil && lookup.err != ErrQueryBudget && len(regexes) >= 1 {
+				return regexes, nil
+			}
+			if lookup.err != nil {
+				return nil, fmt.Errorf("Couldn't fetch the subzones for predefined regex: %s", lookup.err.Error())
+			}
+			regex, err := newRegexRecord(start+i, lookup.txt)
+			if err != nil {
+				return nil, err
+			}
+			regexes = append(regexes, regex)
+		}
+	}
+}
+
+// fetchIndexedRegexes fetches the subzones listed in the record's index=
+// field. The index is rejected if any of the listed subzones is missing or,
+// for the numbered indexes, if there are more subzones than listed.
+func (p *Path) fetchIndexedRegexes() ([]RegexRecord, error) {
+	labels := p.rec.Index
+	next := numberedIndex(labels)
+	if next != "" {
+		labels = append(labels[:len(labels):len(labels)], next)
+	}
+
+	lookups := p.lookupRegexes(labels)
 	regexes := []RegexRecord{}
-	for i, loop := 1, true; loop != false; i++ {
-		// Send a DNS query to each predefined regex record
-		txts, err := query(fmt.Sprintf("%d.%s", i, UpstreamZone(p.req)), p.req.Context(), p.c)
-		if err != nil && len(regexes) >= 1 {
-			break
+	for i, label := range p.rec.Index {
+		if lookups[i].err != nil {
+			return nil, fmt.Errorf("Couldn't fetch the %s subzone listed in the index: %s", label, lookups[i].err.Error())
 		}
+		regex, err := newRegexRecord(i+1, lookups[i].txt)
 		if err != nil {
-			return nil, fmt.Errorf("Couldn't fetch the subzones for predefined regex: %s", err.Error())
+			return nil, err
 		}
+		regexes = append(regexes, regex)
+	}
 
-		// All predefined regex records should contain the re= field (even non-path records)
-		if !strings.Contains(txts[0], "re=") {
-			return nil, fmt.Errorf("Couldn't find the re= field in records: %s", err.Error())
+	if next != "" {
+		if err := lookups[len(lookups)-1].err; err == nil {
+			return nil, fmt.Errorf("The index lists %d subzones but the %s subzone exists too", len(p.rec.Index), next)
+		} else if err == ErrQueryBudget {
+			return nil, fmt.Errorf("Couldn't verify the index: %s", err.Error())
 		}
+	}
+	return regexes, nil
+}
 
-		// Extract the re= field from record and add it to the regex slice
-		regexes = append(regexes, RegexRecord{
-			Position: i,
-			TXT:      txts[0],
-			Regex:    strings.TrimPrefix(strings.Split(txts[0][strings.Index(txts[0], "re="):], ";")[0], "re="),
-		})
+// regexBatchSize returns how many predefined regex subzones are queried at
+// once. When the request has a query budget the subzones are queried one by
+// one, so the queries past the last subzone don't use it up and the budget
+// runs out in order.
+func (p *Path) regexBatchSize() int {
+	if hasQueryBudget(p.req.Context()) {
+		return 1
 	}
+	return regexBatchSize
+}
 
-	sort.Slice(regexes, func(i, j int) bool {
-		return regexes[i].Position < regexes[j].Position
-	})
+// lookupRegexes queries the given subzones of the upstream zone with at
+// most regexBatchSize queries in flight and returns the results in order
+func (p *Path) lookupRegexes(labels []string) []regexLookup {
+	zone := UpstreamZone(p.req)
+	lookups := make([]regexLookup, len(labels))
+	sem := make(chan struct{}, p.regexBatchSize())
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, label string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Send a DNS query to each predefined regex record
+			txt, err := queryRecord(fmt.Sprintf("%s.%s", label, zone), p.req.Context(), p.c)
+			lookups[i] = regexLookup{txt: txt, err: err}
+		}(i, label)
+	}
+	wg.Wait()
+	return lookups
+}
 
-	return regexes, nil
+// newRegexRecord extracts the re= field of the given predefined regex record
+func newRegexRecord(position int, txt string) (RegexRecord, error) {
+	fields, _, err := tokenizeRecord(txt)
+	if err != nil {
+		return RegexRecord{}, fmt.Errorf("Couldn't parse the predefined regex record: %s", err.Error())
+	}
+	// All predefined regex records should contain the re= field (even non-path records)
+	for _, f := range fields {
+		if f.key == "re" && f.err == nil {
+			return RegexRecord{Position: position, TXT: txt, Regex: f.value}, nil
+		}
+	}
+	return RegexRecord{}, fmt.Errorf("Couldn't find the re= field in records: %s", txt)
 }
 
 // zoneFromPath generates a DNS zone with the given request's path and host
 // It will use custom regex to parse the path if it's provided in
 // the given record.
-func zoneFromPath(r *http.Request, rec Record) (string, int, []string, error) {
+func zoneFromPath(r *http.Request, rec Record, c Config) (string, int, []string, error) {
 	path := r.URL.Path
 
 	// Only add request query to path if the custom regex needs it. Unless it
@@ -215,9 +313,10 @@ func zoneFromPath(r *http.Request, rec Record) (string, int, []string, error) {
 	// Use the custom regex to parse request's path
 	if rec.Re != "" {
 		// Compile the record regex and find path submatches
-		CustomRegex, err := regexp.Compile(rec.Re)
+		CustomRegex, err := compileRegex(rec.Re)
 		if err != nil {
 			log.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
+			return "", 0, []string{}, fmt.Errorf("couldn't compile the custom regex: %s", err.Error())
 		}
 		pathSubmatchs = CustomRegex.FindAllStringSubmatch(path, -1)
 
@@ -237,11 +336,11 @@ func zoneFromPath(r *http.Request, rec Record) (string, int, []string, error) {
 
 			url := sortMap(unordered)
 			*r = *r.WithContext(context.WithValue(r.Context(), "regexMatches", unordered))
-			url = normalize(url)
+			url = encodePathLabels(normalize(url))
 			reverse(url)
 			from := len(pathSlice)
 			url = append(url, UpstreamZone(r))
-			url = append([]string{basezone}, url...)
+			url = append([]string{c.baseZone()}, url...)
 			return strings.Join(url, "."), from, pathSlice, nil
 		}
 	}
@@ -282,37 +381,40 @@ func zoneFromPath(r *http.Request, rec Record) (string, int, []string, error) {
 			generatedPath = append(generatedPath, fromSlice[k])
 		}
 
-		url := append(generatedPath, UpstreamZone(r))
-		url = append([]string{basezone}, url...)
+		url := append(encodePathLabels(generatedPath), UpstreamZone(r))
+		url = append([]string{c.baseZone()}, url...)
 		return strings.Join(url, "."), from, pathSlice, nil
 	}
 	ps := pathSlice
 	reverse(pathSlice)
-	url := append(pathSlice, UpstreamZone(r))
-	url = append([]string{basezone}, url...)
+	url := append(encodePathLabels(pathSlice), UpstreamZone(r))
+	url = append([]string{c.baseZone()}, url...)
 	return strings.Join(url, "."), from, ps, nil
 }
 
 // getFinalRecord finds the final TXT record for the given zone.
 // It will try wildcards if the first zone return error
 func getFinalRecord(zone string, from int, c Config, w http.ResponseWriter, r *http.Request, pathSlice []string) (Record, error) {
-	txts, err := query(zone, r.Context(), c)
-	if err != nil {
+	txt, err := queryRecord(zone, r.Context(), c)
+	if err != nil && !isConflict(err) {
 		// if nothing found, jump into wildcards
-		for i := 1; i <= from && len(txts) == 0; i++ {
+		for i := 1; i <= from && txt == ""; i++ {
 			zoneSlice := strings.Split(zone, ".")
 			zoneSlice[i] = "_"
 			zone = strings.Join(zoneSlice, ".")
-			txts, err = query(zone, r.Context(), c)
+			txt, err = queryRecord(zone, r.Context(), c)
+			if isConflict(err) || err == ErrQueryBudget {
+				break
+			}
 		}
 	}
-	if err != nil || len(txts) == 0 {
+	if err != nil || txt == "" {
 		return Record{}, fmt.Errorf("could not get TXT record: %s", err)
 	}
 
-	txts[0], err = parsePlaceholders(txts[0], r, pathSlice)
+	txt, err = parsePlaceholders(txt, r, pathSlice)
 	var rec Record
-	if rec, err = ParseRecord(txts[0], w, r, c); err != nil {
+	if rec, err = ParseRecord(txt, w, r, c); err != nil {
 		return rec, fmt.Errorf("could not parse record: %s", err)
 	}
 
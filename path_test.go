@@ -14,9 +14,13 @@ limitations under the License.
 package txtdirect
 
 import (
+	"context"
 	"fmt"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_zoneFromPath(t *testing.T) {
@@ -159,7 +163,7 @@ func Test_zoneFromPath(t *testing.T) {
 		rec.Re = test.regex
 		rec.From = test.from
 		req := httptest.NewRequest("GET", test.url, nil)
-		zone, _, _, err := zoneFromPath(req, rec)
+		zone, _, _, err := zoneFromPath(req, rec, Config{})
 		if err != nil {
 			// Check negative tests
 			if test.err != nil {
@@ -234,7 +238,7 @@ func Test_zoneFromPathRegexPlaceholders(t *testing.T) {
 			To:   test.to,
 		}
 		req := httptest.NewRequest("GET", test.url, nil)
-		_, _, _, err := zoneFromPath(req, rec)
+		_, _, _, err := zoneFromPath(req, rec, Config{})
 		if err != nil {
 			t.Errorf("Unexpected error while parsing path: %s", err.Error())
 		}
@@ -247,3 +251,188 @@ func Test_zoneFromPathRegexPlaceholders(t *testing.T) {
 		}
 	}
 }
+
+// concurrentSource tracks the concurrent lookups sent to the map source
+type concurrentSource struct {
+	source   mapSource
+	mu       sync.Mutex
+	inflight int
+	peak     int
+	lookups  int
+}
+
+func (s *concurrentSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	s.mu.Lock()
+	s.inflight++
+	s.lookups++
+	if s.inflight > s.peak {
+		s.peak = s.inflight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	return s.source.LookupTXT(ctx, zone)
+}
+
+func Test_fetchRegexes(t *testing.T) {
+	tests := []struct {
+		positions []int
+		expected  int
+		err       bool
+	}{
+		{
+			positions: []int{1, 2, 3},
+			expected:  3,
+		},
+		{
+			positions: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			expected:  20,
+		},
+		{
+			// The subzones after the first missing one are ignored
+			positions: []int{1, 2, 4, 5},
+			expected:  2,
+		},
+		{
+			positions: []int{2, 3},
+			err:       true,
+		},
+	}
+	for i, test := range tests {
+		source := &concurrentSource{source: mapSource{}}
+		for _, position := range test.positions {
+			zone := fmt.Sprintf("_redirect.%d.regex.example.test.", position)
+			source.source[zone] = []string{fmt.Sprintf("v=txtv0;to=https://%d.target.test;re=^/%d$;type=host", position, position)}
+		}
+
+		req := httptest.NewRequest("GET", "https://regex.example.test/", nil)
+		p := NewPath(httptest.NewRecorder(), req, "/", Record{}, Config{Source: source})
+		regexes, err := p.fetchRegexes()
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if len(regexes) != test.expected {
+			t.Errorf("Test %d: Expected %d regexes, got %d", i, test.expected, len(regexes))
+		}
+		for j, regex := range regexes {
+			if regex.Position != j+1 || regex.Regex != fmt.Sprintf("^/%d$", j+1) {
+				t.Errorf("Test %d: Unexpected regex at position %d: %+v", i, j+1, regex)
+			}
+		}
+		if source.peak < 2 || source.peak > regexBatchSize {
+			t.Errorf("Test %d: Expected up to %d concurrent lookups, got %d", i, regexBatchSize, source.peak)
+		}
+		if max := test.expected + regexBatchSize; source.lookups > max {
+			t.Errorf("Test %d: Expected at most %d lookups, got %d", i, max, source.lookups)
+		}
+	}
+}
+
+func Test_fetchIndexedRegexes(t *testing.T) {
+	tests := []struct {
+		subzones []string
+		index    string
+		expected []string
+		err      bool
+	}{
+		{
+			subzones: []string{"1", "2", "3"},
+			index:    "3",
+			expected: []string{"1", "2", "3"},
+		},
+		{
+			// A missing subzone doesn't truncate the list
+			subzones: []string{"1", "3"},
+			index:    "3",
+			err:      true,
+		},
+		{
+			subzones: []string{"1", "2", "3", "4"},
+			index:    "3",
+			err:      true,
+		},
+		{
+			subzones: []string{"docs", "api", "1"},
+			index:    "api,docs",
+			expected: []string{"api", "docs"},
+		},
+		{
+			subzones: []string{"docs"},
+			index:    "api,docs",
+			err:      true,
+		},
+	}
+	for i, test := range tests {
+		source := &concurrentSource{source: mapSource{}}
+		for _, label := range test.subzones {
+			zone := fmt.Sprintf("_redirect.%s.regex.example.test.", label)
+			source.source[zone] = []string{fmt.Sprintf("v=txtv0;to=https://%s.target.test;re=^/%s$;type=host", label, label)}
+		}
+		index, err := parseRegexIndex(test.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "https://regex.example.test/", nil)
+		p := NewPath(httptest.NewRecorder(), req, "/", Record{Re: "record", Index: index}, Config{Source: source})
+		regexes, err := p.fetchRegexes()
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if len(regexes) != len(test.expected) {
+			t.Errorf("Test %d: Expected %d regexes, got %d", i, len(test.expected), len(regexes))
+			continue
+		}
+		for j, regex := range regexes {
+			if regex.Position != j+1 || regex.Regex != "^/"+test.expected[j]+"$" {
+				t.Errorf("Test %d: Unexpected regex at position %d: %+v", i, j+1, regex)
+			}
+		}
+	}
+}
+
+func BenchmarkZoneFromPath(b *testing.B) {
+	rec := Record{Re: "\\/(?P<version>v[0-9]+)\\/(?P<page>[a-z]+)"}
+	c := Config{}
+	run := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			req := httptest.NewRequest("GET", "https://example.com/v2/docs", nil)
+			if _, _, _, err := zoneFromPath(req, rec, c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("cached", run)
+
+	// A cache without any room compiles the regex on every request
+	defer func(cache *regexCache) { compiledRegexes = cache }(compiledRegexes)
+	compiledRegexes = newRegexCache(0)
+	b.Run("uncached", run)
+}
+
+func TestPathRedirectInvalidRegex(t *testing.T) {
+	source := &countingSource{source: mapSource{
+		"_redirect.regex.example.test.": {"v=txtv1;type=path;re=^/(a;to=https://fallback.target.test"},
+	}}
+	c := Config{Enable: []string{"path"}, Source: source}
+	req := httptest.NewRequest("GET", "https://regex.example.test/a", nil)
+	resp := httptest.NewRecorder()
+
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://fallback.target.test" {
+		t.Errorf("Expected the fallback to be triggered, got %s", location)
+	}
+	// The path record is the only lookup
+	if lookups := atomic.LoadInt32(&source.lookups); lookups != 1 {
+		t.Errorf("Expected a single lookup, got %d", lookups)
+	}
+}
@@ -27,6 +27,12 @@ import (
 // PlaceholderRegex finds the placeholders like {x}
 var PlaceholderRegex = regexp.MustCompile("{[~>?$]?\\w+}")
 
+// NumberedMatchRegex finds the numbered regex match placeholders like {1}
+var NumberedMatchRegex = regexp.MustCompile("(\\d+)")
+
+// NamedMatchRegex finds the named regex match placeholders like {$name}
+var NamedMatchRegex = regexp.MustCompile("(\\$[a-zA-Z]+[0-9]*)")
+
 // parsePlaceholders gets a string input and looks for placeholders inside
 // the string. it will then replace them with the actual data from the request
 func parsePlaceholders(input string, r *http.Request, pathSlice []string) (string, error) {
@@ -117,7 +123,7 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 		}
 
 		// Numbered Regex matches
-		if regexp.MustCompile("(\\d+)").MatchString(string(placeholder[0][1])) {
+		if NumberedMatchRegex.MatchString(string(placeholder[0][1])) {
 			matches := r.Context().Value("regexMatches")
 			index, err := strconv.Atoi(string(placeholder[0][1]))
 			if err != nil {
@@ -128,7 +134,7 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 		}
 
 		// Named regex matches
-		if regexp.MustCompile("(\\$[a-zA-Z]+[0-9]*)").MatchString(string(placeholder[0][1 : len(placeholder[0])-1])) {
+		if NamedMatchRegex.MatchString(string(placeholder[0][1 : len(placeholder[0])-1])) {
 			matches := r.Context().Value("regexMatches")
 			mapReflect := reflect.ValueOf(matches)
 			if mapReflect.Kind() == reflect.Map {
@@ -14,8 +14,10 @@ limitations under the License.
 package txtdirect
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 )
 
@@ -198,3 +200,29 @@ func TestParsePlaceholdersFails(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkParsePlaceholders(b *testing.B) {
+	req := httptest.NewRequest("GET", "https://example.com/v2/docs?page=1", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "regexMatches", []string{"/v2/docs", "v2", "docs"}))
+	for i := 0; i < b.N; i++ {
+		if _, err := parsePlaceholders("https://{host}/{1}/{2}{?page}{$1}", req, []string{"v2"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlaceholderMatch(b *testing.B) {
+	placeholder := "{$name}"
+	b.Run("precompiled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NumberedMatchRegex.MatchString(placeholder[1:2])
+			NamedMatchRegex.MatchString(placeholder[1 : len(placeholder)-1])
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			regexp.MustCompile("(\\d+)").MatchString(placeholder[1:2])
+			regexp.MustCompile("(\\$[a-zA-Z]+[0-9]*)").MatchString(placeholder[1 : len(placeholder)-1])
+		}
+	})
+}
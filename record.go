@@ -17,13 +17,25 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
 )
 
+// maxRecordLength is the maximum length of a TXT record after the
+// character-strings of the record are concatenated
+const maxRecordLength = 4096
+
+// maxRegexIndex limits how many predefined regex subzones the index= field
+// can list
+const maxRegexIndex = 64
+
 type Record struct {
 	Version string
 	To      string
@@ -35,6 +47,7 @@ type Record struct {
 	From    string
 	Root    string
 	Re      string
+	Index   []string
 	Ref     bool
 	Headers map[string]string
 }
@@ -44,37 +57,40 @@ type Record struct {
 // struct instance. It returns an error when it can't find any txt
 // records or if the TXT record is not standard.
 func GetRecord(host string, c Config, w http.ResponseWriter, r *http.Request) (Record, error) {
-	txts, err := query(host, r.Context(), c)
+	txt, err := queryRecord(host, r.Context(), c)
 	if err != nil {
 		log.Printf("Initial DNS query failed: %s", err)
 	}
 
 	// If record isn't on apex zone, check the "_" subzone
-	if err != nil && r.Context().Value("records") == nil {
-		txts, err = query(fmt.Sprintf("_.%s", host), r.Context(), c)
+	if err != nil && !isConflict(err) && err != ErrQueryBudget && r.Context().Value("records") == nil {
+		txt, err = queryRecord(fmt.Sprintf("_.%s", host), r.Context(), c)
 		if err != nil {
 			log.Printf("Apex zone's wildcard DNS query failed: %s", err)
 		}
 	}
 
+	// Conflicting records shouldn't be hidden by the wildcards
+	if isConflict(err) || err == ErrQueryBudget {
+		return Record{}, err
+	}
+
 	// if error present or record empty, jump into wildcards
-	if err != nil || txts[0] == "" {
-		hostSlice := strings.Split(host, ".")
-		hostSlice[0] = "_"
-		host = strings.Join(hostSlice, ".")
-		txts, err = query(host, r.Context(), c)
-		if err != nil {
+	if err != nil || txt == "" {
+		for _, zone := range wildcardZones(host, c.WildcardDepth) {
+			txt, err = queryRecord(zone, r.Context(), c)
+			if err == nil || isConflict(err) || err == ErrQueryBudget {
+				break
+			}
 			log.Printf("Wildcard DNS query failed: %s", err.Error())
+		}
+		if err != nil {
 			return Record{}, err
 		}
 	}
 
-	if len(txts) != 1 {
-		return Record{}, fmt.Errorf("could not parse TXT record with %d records", len(txts))
-	}
-
 	var rec Record
-	if rec, err = ParseRecord(txts[0], w, r, c); err != nil {
+	if rec, err = ParseRecord(txt, w, r, c); err != nil {
 		return rec, fmt.Errorf("could not parse record: %s", err)
 	}
 
@@ -95,49 +111,59 @@ func GetRecord(host string, c Config, w http.ResponseWriter, r *http.Request) (R
 // It will return an error if the DNS TXT record is not standard or
 // if the record type is not enabled in the TXTDirect's config.
 func ParseRecord(str string, w http.ResponseWriter, req *http.Request, c Config) (Record, error) {
-	r := Record{
-		Headers: map[string]string{},
+	if len(str) > maxRecordLength {
+		return Record{}, fmt.Errorf("TXT record cannot exceed the maximum of %d characters", maxRecordLength)
 	}
 
-	s := strings.Split(str, ";")
+	fields, format, err := tokenizeRecord(str)
+	if err != nil {
+		return Record{}, err
+	}
 
-	// Trim whitespace both leading and trailing
-	for i := range s {
-		s[i] = strings.TrimSpace(s[i])
+	r := Record{
+		Headers: map[string]string{},
 	}
 
-	for _, l := range s {
-		switch {
-		case strings.HasPrefix(l, "code="):
-			l = strings.TrimPrefix(l, "code=")
+	for _, f := range fields {
+		if f.err != nil {
+			return Record{}, f.err
+		}
+		l := f.value
+
+		switch f.key {
+		case "code":
 			i, err := strconv.Atoi(l)
 			if err != nil {
 				return Record{}, fmt.Errorf("could not parse status code: %s", err)
 			}
 			r.Code = i
 
-		case strings.HasPrefix(l, "from="):
-			l = strings.TrimPrefix(l, "from=")
+		case "from":
 			l, err := parsePlaceholders(l, req, []string{})
 			if err != nil {
 				return Record{}, err
 			}
 			r.From = l
 
-		case strings.HasPrefix(l, "re="):
-			l = strings.TrimPrefix(l, "re=")
+		case "index":
+			index, err := parseRegexIndex(l)
+			if err != nil {
+				return Record{}, err
+			}
+			r.Index = index
+
+		case "re":
 			r.Re = l
 
-		case strings.HasPrefix(l, "ref="):
-			l, err := strconv.ParseBool(strings.TrimPrefix(l, "ref="))
+		case "ref":
+			l, err := strconv.ParseBool(l)
 			if err != nil {
 				fallback(w, req, "global", http.StatusMovedPermanently, c)
 				return Record{}, err
 			}
 			r.Ref = l
 
-		case strings.HasPrefix(l, "root="):
-			l = strings.TrimPrefix(l, "root=")
+		case "root":
 			l, err := parsePlaceholders(l, req, []string{})
 			if err != nil {
 				return Record{}, err
@@ -145,8 +171,7 @@ func ParseRecord(str string, w http.ResponseWriter, req *http.Request, c Config)
 			l = ParseURI(l, w, req, c)
 			r.Root = l
 
-		case strings.HasPrefix(l, "to="):
-			l = strings.TrimPrefix(l, "to=")
+		case "to":
 			l, err := parsePlaceholders(l, req, []string{})
 			if err != nil {
 				return Record{}, err
@@ -154,52 +179,46 @@ func ParseRecord(str string, w http.ResponseWriter, req *http.Request, c Config)
 			l = ParseURI(l, w, req, c)
 			r.To = l
 
-		case strings.HasPrefix(l, "type="):
-			l = strings.TrimPrefix(l, "type=")
+		case "type":
 			r.Type = l
 
-		case strings.HasPrefix(l, "use="):
-			l = strings.TrimPrefix(l, "use=")
-			if !strings.HasPrefix(l, "_redirect.") {
+		case "use":
+			if !strings.HasPrefix(l, c.baseZone()+".") {
 				return Record{}, fmt.Errorf("The given zone address is invalid")
 			}
 			r.Use = append(r.Use, l)
 
-		case strings.HasPrefix(l, "v="):
-			l = strings.TrimPrefix(l, "v=")
+		case "v":
 			r.Version = l
-			if r.Version != "txtv0" {
+			if r.Version != format {
 				return Record{}, fmt.Errorf("unhandled version '%s'", r.Version)
 			}
-			log.Print("WARN: txtv0 is not suitable for production")
+			if r.Version == RecordV0 {
+				log.Print("WARN: txtv0 is not suitable for production")
+			}
 
-		case strings.HasPrefix(l, "vcs="):
-			l = strings.TrimPrefix(l, "vcs=")
+		case "vcs":
 			r.Vcs = l
 
-		case strings.HasPrefix(l, "website="):
-			l = strings.TrimPrefix(l, "website=")
+		case "website":
 			l = ParseURI(l, w, req, c)
 			r.Website = l
-		case strings.HasPrefix(l, ">"):
-			header := strings.Split(l, "=")
-			h, err := url.PathUnescape(header[1])
-			if err != nil {
-				return Record{}, err
-			}
-			r.Headers[header[0][1:]] = h
 		default:
-			tuple := strings.Split(l, "=")
-			if len(tuple) != 2 {
-				return Record{}, fmt.Errorf("arbitrary data not allowed")
+			if strings.HasPrefix(f.key, ">") {
+				r.Headers[f.key[1:]] = l
+				continue
+			}
+			// Unknown fields are ignored in txtv0 records
+			if format == RecordV1 {
+				return Record{}, fmt.Errorf("unknown field %s", f.key)
 			}
-			continue
-		}
-		if len(l) > 255 {
-			return Record{}, fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
 		}
 	}
 
+	if len(r.Index) > 0 && r.Re != "record" {
+		return Record{}, fmt.Errorf("index= field can only be used with re=record")
+	}
+
 	if r.Type == "dockerv2" && r.To == "" {
 		return Record{}, fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
 	}
@@ -227,6 +246,131 @@ func ParseRecord(str string, w http.ResponseWriter, req *http.Request, c Config)
 	return r, nil
 }
 
+// String returns the canonical txtv1 TXT record of the record. The fields
+// are written in a stable order and the default values, such as code=302,
+// are left out. Values are quoted only when they need to be.
+func (rec Record) String() string {
+	fields := []string{"v=" + RecordV1}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+formatValue(value))
+		}
+	}
+
+	if rec.Type != "host" || len(rec.Use) != 0 {
+		add("type", rec.Type)
+	}
+	add("to", rec.To)
+	if rec.Code != 0 && rec.Code != http.StatusFound {
+		add("code", strconv.Itoa(rec.Code))
+	}
+	add("root", rec.Root)
+	add("from", rec.From)
+	add("re", rec.Re)
+	add("index", formatRegexIndex(rec.Index))
+	if rec.Ref {
+		add("ref", "true")
+	}
+	for _, use := range rec.Use {
+		add("use", use)
+	}
+	add("vcs", rec.Vcs)
+	add("website", rec.Website)
+
+	headers := make([]string, 0, len(rec.Headers))
+	for header := range rec.Headers {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	for _, header := range headers {
+		fields = append(fields, ">"+header+"="+formatValue(rec.Headers[header]))
+	}
+
+	return strings.Join(fields, ";")
+}
+
+// MarshalText returns the canonical txtv1 TXT record of the record. It
+// returns an error if the record can't be written as a TXT record.
+func (rec Record) MarshalText() ([]byte, error) {
+	seen := map[string]bool{}
+	for header := range rec.Headers {
+		if header == "" {
+			return nil, fmt.Errorf("header names can't be empty")
+		}
+		for i := 0; i < len(header); i++ {
+			if !isKeyChar(header[i], true) {
+				return nil, fmt.Errorf("invalid character %q in header %q", header[i], header)
+			}
+		}
+		if seen[http.CanonicalHeaderKey(header)] {
+			return nil, fmt.Errorf("duplicate %s header", header)
+		}
+		seen[http.CanonicalHeaderKey(header)] = true
+	}
+
+	txt := rec.String()
+	if len(txt) > maxRecordLength {
+		return nil, fmt.Errorf("TXT record cannot exceed the maximum of %d characters", maxRecordLength)
+	}
+	return []byte(txt), nil
+}
+
+// parseRegexIndex parses the index= field which either contains the number
+// of the predefined regex subzones, e.g. "3" for 1, 2 and 3, or the comma
+// separated list of their labels.
+func parseRegexIndex(index string) ([]string, error) {
+	if n, err := strconv.Atoi(index); err == nil {
+		if n < 1 || n > maxRegexIndex {
+			return nil, fmt.Errorf("index= field must be between 1 and %d", maxRegexIndex)
+		}
+		labels := make([]string, n)
+		for i := range labels {
+			labels[i] = strconv.Itoa(i + 1)
+		}
+		return labels, nil
+	}
+
+	labels := strings.Split(index, ",")
+	if len(labels) > maxRegexIndex {
+		return nil, fmt.Errorf("index= field can't list more than %d subzones", maxRegexIndex)
+	}
+	seen := map[string]bool{}
+	for i, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if _, ok := dns.IsDomainName(label); !ok || label == "" || strings.Contains(label, ".") {
+			return nil, fmt.Errorf("index= field contains an invalid subzone label: %q", label)
+		}
+		if seen[label] {
+			return nil, fmt.Errorf("index= field lists the %s subzone more than once", label)
+		}
+		seen[label] = true
+		labels[i] = label
+	}
+	return labels, nil
+}
+
+// formatRegexIndex returns the index= field of the given subzone labels
+func formatRegexIndex(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	if numberedIndex(labels) != "" {
+		return strconv.Itoa(len(labels))
+	}
+	return strings.Join(labels, ",")
+}
+
+// numberedIndex returns the label after the last subzone if the given index
+// lists the numbered subzones from 1 up, otherwise an empty string
+func numberedIndex(labels []string) string {
+	for i, label := range labels {
+		if label != strconv.Itoa(i+1) {
+			return ""
+		}
+	}
+	return strconv.Itoa(len(labels) + 1)
+}
+
 // Adds the given record to the request's context with "records" key.
 func (rec Record) addToContext(r *http.Request) *http.Request {
 	// Fetch fallback config from context and add the record to it
@@ -272,12 +416,10 @@ func (rec *Record) CheckUpstream(w http.ResponseWriter, r *http.Request, c Confi
 
 		*rec = upstreamRec
 
-		zoneSplited := strings.Split(zone, ".")
-
 		return r.WithContext(context.WithValue(
 			r.Context(),
 			"upstreamZone",
-			strings.Join(zoneSplited[1:], "."),
+			strings.TrimPrefix(zone, c.baseZone()+"."),
 		)), nil
 	}
 	return r, nil
@@ -306,15 +448,24 @@ func getBaseTarget(rec Record, r *http.Request) (string, int, error) {
 	return rec.To, rec.Code, nil
 }
 
-func absoluteZone(zone string) string {
+// baseZone returns the zone prefix used to look up the records
+func (c Config) baseZone() string {
+	if c.BaseZone != "" {
+		return c.BaseZone
+	}
+	return basezone
+}
+
+func absoluteZone(zone string, c Config) string {
 	// Removes port from zone
 	if strings.Contains(zone, ":") {
 		zoneSlice := strings.Split(zone, ":")
 		zone = zoneSlice[0]
 	}
+	zone = asciiZone(zone)
 
-	if !strings.HasPrefix(zone, basezone) {
-		zone = strings.Join([]string{basezone, zone}, ".")
+	if !strings.HasPrefix(zone, c.baseZone()+".") {
+		zone = strings.Join([]string{c.baseZone(), zone}, ".")
 	}
 
 	if strings.HasSuffix(zone, ".") {
@@ -324,22 +475,98 @@ func absoluteZone(zone string) string {
 	return strings.Join([]string{zone, "."}, "")
 }
 
-// query checks the given zone using net.LookupTXT to
-// find TXT records in that zone
-func query(zone string, ctx context.Context, c Config) ([]string, error) {
-	var txts []string
-	var err error
-	if c.Resolver != "" {
-		net := customResolver(c)
-		txts, err = net.LookupTXT(ctx, absoluteZone(zone))
-	} else {
-		txts, err = net.LookupTXT(absoluteZone(zone))
+// wildcardZones returns the wildcard zones tried for the given host, from
+// the most specific one up to the registrable domain's wildcard. Each level
+// replaces one more label with "_", e.g. _.b.example.com and then _.example.com
+// for a.b.example.com. The depth limits how many levels are tried.
+func wildcardZones(host string, depth int) []string {
+	host = asciiZone(strings.Split(host, ":")[0])
+	labels := strings.Split(host, ".")
+
+	// The first label is always replaced, even on the registrable domain
+	zones := []string{strings.Join(append([]string{"_"}, labels[1:]...), ".")}
+
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return zones
 	}
+	minLabels := strings.Count(registrable, ".") + 1
+	for i := 2; i <= depth && len(labels)-i >= minLabels; i++ {
+		zones = append(zones, strings.Join(append([]string{"_"}, labels[i:]...), "."))
+	}
+	return zones
+}
+
+// ConflictError is returned when a zone has more than one TXTDirect record
+type ConflictError struct {
+	Zone    string
+	Records []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s has %d conflicting TXTDirect records: %q", e.Zone, len(e.Records), e.Records)
+}
+
+func isConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// queryRecord finds the TXTDirect record of the given zone among its TXT records
+func queryRecord(zone string, ctx context.Context, c Config) (string, error) {
+	txts, err := query(zone, ctx, c)
 	if err != nil {
-		return nil, fmt.Errorf("could not get TXT record: %s", err)
+		return "", err
+	}
+	return selectRecord(absoluteZone(zone, c), txts)
+}
+
+// selectRecord picks the TXTDirect record using the v= version tag and
+// ignores the other TXT records at the same name, e.g. verification tokens.
+// A single TXT record is always returned, so the records without the version
+// tag keep working when they're the only record.
+func selectRecord(zone string, txts []string) (string, error) {
+	if len(txts) == 1 {
+		return txts[0], nil
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if isTXTDirectRecord(txt) {
+			records = append(records, txt)
+		}
 	}
-	if txts[0] == "" {
-		return nil, fmt.Errorf("TXT record doesn't exist or is empty")
+	switch len(records) {
+	case 0:
+		return "", fmt.Errorf("could not find a TXTDirect record among the %d TXT records of %s", len(txts), zone)
+	case 1:
+		return records[0], nil
 	}
-	return txts, nil
+	return "", &ConflictError{Zone: zone, Records: records}
+}
+
+// isTXTDirectRecord checks if the TXT record has a TXTDirect version tag
+func isTXTDirectRecord(txt string) bool {
+	for _, field := range strings.Split(txt, ";") {
+		if strings.HasPrefix(strings.TrimSpace(field), "v=txtv") {
+			return true
+		}
+	}
+	return false
+}
+
+// query checks the given zone's TXT records in the static records and the
+// record cache and uses the config's record source if they aren't found
+func query(zone string, ctx context.Context, c Config) ([]string, error) {
+	zone = absoluteZone(zone, c)
+	if txt, ok := c.Records[strings.ToLower(zone)]; ok {
+		return []string{txt}, nil
+	}
+	return c.Cache.lookup(ctx, zone, func(ctx context.Context) ([]string, time.Duration, error) {
+		// Only the lookups that miss the cache use the request's budget
+		if err := takeQuery(ctx); err != nil {
+			return nil, 0, err
+		}
+		return c.source().LookupTXT(ctx, zone)
+	})
 }
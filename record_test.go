@@ -15,10 +15,17 @@ package txtdirect
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"testing/quick"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
 func TestParseRecord(t *testing.T) {
@@ -86,15 +93,30 @@ func TestParseRecord(t *testing.T) {
 			err:       fmt.Errorf("could not parse status code"),
 		},
 		{
-			txtRecord: "v=txtv1;to=https://example.com/;code=test",
+			txtRecord: "v=txtv2;to=https://example.com/;code=test",
 			expected:  Record{},
-			err:       fmt.Errorf("unhandled version 'txtv1'"),
+			err:       fmt.Errorf("unhandled version 'txtv2'"),
 		},
 		{
 			txtRecord: "v=txtv0;https://example.com/",
 			expected:  Record{},
 			err:       fmt.Errorf("arbitrary data not allowed"),
 		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/" + strings.Repeat("a", 300) + ";code=302",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/" + strings.Repeat("a", 300),
+				Code:    302,
+				Type:    "host",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/" + strings.Repeat("a", maxRecordLength),
+			expected:  Record{},
+			err:       fmt.Errorf("TXT record cannot exceed the maximum of 4096 characters"),
+		},
 		{
 			txtRecord: "v=txtv0;to=https://example.com/caddy;type=path;code=302",
 			expected: Record{
@@ -398,3 +420,557 @@ func TestParseRecord(t *testing.T) {
 		}
 	}
 }
+
+func TestRecordOverrides(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`txtdirect {
+		enable host path gometa
+		redirect https://fallback.test
+		record go.override.test "v=txtv0;to=https://github.com/example;type=gometa"
+		record Host.Override.Test "v=txtv0;to=https://pinned.target.test;type=host"
+		record path.override.test "v=txtv0;type=path;root=https://root.target.test"
+		record _redirect.docs.path.override.test "v=txtv0;to=https://docs.target.test;type=host"
+	}`)
+	c, err := ParseCaddy(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The overrides are consulted before the record source
+	c.Source = mapSource{
+		"_redirect.host.override.test.": {"v=txtv0;to=https://dns.target.test;type=host"},
+		"_redirect.dns.override.test.":  {"v=txtv0;to=https://dns.target.test;type=host"},
+	}
+
+	tests := []struct {
+		url      string
+		location string
+		body     string
+	}{
+		{
+			url:  "https://go.override.test/?go-get=1",
+			body: "go.override.test git https://github.com/example",
+		},
+		{
+			url:      "https://host.override.test",
+			location: "https://pinned.target.test",
+		},
+		{
+			url:      "https://path.override.test/docs",
+			location: "https://docs.target.test",
+		},
+		{
+			url:      "https://path.override.test/",
+			location: "https://root.target.test",
+		},
+		{
+			url:      "https://dns.override.test",
+			location: "https://dns.target.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, *c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+		if !strings.Contains(resp.Body.String(), test.body) {
+			t.Errorf("Test %d: Expected %s to be in the body:\n%s", i, test.body, resp.Body.String())
+		}
+	}
+}
+
+func TestRecordOverridesInvalid(t *testing.T) {
+	tests := []string{
+		`record host.override.test`,
+		`record host.override.test "v=txtv2;to=https://target.test"`,
+		`record host.override.test "v=txtv0;type=host"`,
+		`record host.override.test "v=txtv0;to=https://target.test;code=abc"`,
+		`record host.override.test "v=txtv0;to=https://target.test;type=dockerv2"`,
+	}
+	for i, test := range tests {
+		d := caddyfile.NewTestDispenser(fmt.Sprintf("txtdirect {\n\tenable host\n\t%s\n}", test))
+		if _, err := ParseCaddy(d); err == nil {
+			t.Errorf("Test %d: Expected %s to fail the config", i, test)
+		}
+	}
+}
+
+func Test_selectRecord(t *testing.T) {
+	tests := []struct {
+		txts     []string
+		expected string
+		conflict bool
+		err      bool
+	}{
+		{
+			txts:     []string{"to=https://example.com;type=host"},
+			expected: "to=https://example.com;type=host",
+		},
+		{
+			txts: []string{
+				"google-site-verification=abc123",
+				"v=txtv0;to=https://example.com;type=host",
+				"v=spf1 include:_spf.example.com ~all",
+			},
+			expected: "v=txtv0;to=https://example.com;type=host",
+		},
+		{
+			txts: []string{
+				"type=host;to=https://example.com; v=txtv0",
+				"verification=abc123",
+			},
+			expected: "type=host;to=https://example.com; v=txtv0",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://one.example.com",
+				"verification=abc123",
+				"v=txtv0;to=https://two.example.com",
+			},
+			conflict: true,
+		},
+		{
+			txts: []string{"verification=abc123", "v=spf1 -all"},
+			err:  true,
+		},
+	}
+	for i, test := range tests {
+		txt, err := selectRecord("_redirect.example.com.", test.txts)
+		if test.conflict != isConflict(err) {
+			t.Errorf("Test %d: Expected conflict to be %t, got %v", i, test.conflict, err)
+		}
+		if (err != nil) != (test.err || test.conflict) {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if txt != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txt)
+		}
+	}
+}
+
+func TestGetRecordMultipleTXT(t *testing.T) {
+	c := Config{
+		Enable: []string{"host"},
+		Source: mapSource{
+			"_redirect.mixed.example.test.": {
+				"google-site-verification=abc123",
+				"v=txtv0;to=https://mixed.target.test;type=host",
+			},
+			"_redirect.conflict.example.test.": {
+				"v=txtv0;to=https://one.target.test;type=host",
+				"v=txtv0;to=https://two.target.test;type=host",
+			},
+			"_redirect._.example.test.": {"v=txtv0;to=https://wildcard.target.test;type=host"},
+		},
+	}
+	tests := []struct {
+		host     string
+		to       string
+		conflict bool
+	}{
+		{
+			host: "mixed.example.test",
+			to:   "https://mixed.target.test",
+		},
+		{
+			// The conflict isn't hidden by the wildcard record
+			host:     "conflict.example.test",
+			conflict: true,
+		},
+		{
+			host: "missing.example.test",
+			to:   "https://wildcard.target.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := GetRecord(test.host, c, httptest.NewRecorder(), req)
+		if test.conflict {
+			if !isConflict(err) {
+				t.Errorf("Test %d: Expected a conflict error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.to {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.to, rec.To)
+		}
+	}
+}
+
+func Test_wildcardZones(t *testing.T) {
+	tests := []struct {
+		host     string
+		depth    int
+		expected []string
+	}{
+		{
+			host:     "a.b.team.example.com",
+			expected: []string{"_.b.team.example.com"},
+		},
+		{
+			host:     "a.b.team.example.com",
+			depth:    2,
+			expected: []string{"_.b.team.example.com", "_.team.example.com"},
+		},
+		{
+			host:     "a.b.team.example.com:8080",
+			depth:    10,
+			expected: []string{"_.b.team.example.com", "_.team.example.com", "_.example.com"},
+		},
+		{
+			// The walk stops at the registrable domain
+			host:     "a.b.example.co.uk",
+			depth:    10,
+			expected: []string{"_.b.example.co.uk", "_.example.co.uk"},
+		},
+		{
+			host:     "example.com",
+			depth:    10,
+			expected: []string{"_.com"},
+		},
+	}
+	for i, test := range tests {
+		zones := wildcardZones(test.host, test.depth)
+		if strings.Join(zones, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, zones)
+		}
+	}
+}
+
+func TestGetRecordWildcardDepth(t *testing.T) {
+	source := mapSource{
+		"_redirect._.team.example.test.": {"v=txtv0;to=https://team.target.test;type=host"},
+		"_redirect._.example.test.":      {"v=txtv0;to=https://catchall.target.test;type=host"},
+	}
+	tests := []struct {
+		host  string
+		depth int
+		to    string
+	}{
+		{
+			// Only the first level is tried by default
+			host: "a.b.team.example.test",
+		},
+		{
+			host:  "a.b.team.example.test",
+			depth: 2,
+			to:    "https://team.target.test",
+		},
+		{
+			host:  "a.b.other.example.test",
+			depth: 3,
+			to:    "https://catchall.target.test",
+		},
+	}
+	for i, test := range tests {
+		c := Config{Enable: []string{"host"}, WildcardDepth: test.depth, Source: source}
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := GetRecord(test.host, c, httptest.NewRecorder(), req)
+		if test.to == "" {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %s", i, rec.To)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.to {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.to, rec.To)
+		}
+	}
+
+	d := caddyfile.NewTestDispenser(`txtdirect {
+		wildcard_depth 3
+	}`)
+	c, err := ParseCaddy(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.WildcardDepth != 3 {
+		t.Errorf("Expected wildcard_depth to be 3, got %d", c.WildcardDepth)
+	}
+	d = caddyfile.NewTestDispenser(`txtdirect {
+		wildcard_depth 0
+	}`)
+	if _, err := ParseCaddy(d); err == nil {
+		t.Errorf("Expected wildcard_depth 0 to fail the config")
+	}
+}
+
+func TestRedirectBaseZone(t *testing.T) {
+	source := mapSource{
+		"_redirect.host.example.test.":          {"v=txtv0;to=https://production.target.test;type=host"},
+		"_canary.host.example.test.":            {"v=txtv0;to=https://canary.target.test;type=host"},
+		"_canary.path.example.test.":            {"v=txtv0;type=path"},
+		"_canary.docs.path.example.test.":       {"v=txtv0;to=https://docs.canary.target.test;type=host"},
+		"_canary.use.example.test.":             {"v=txtv0;use=_canary.upstream.example.test;type=path"},
+		"_canary.upstream.example.test.":        {"v=txtv0;type=path"},
+		"_canary.docs.upstream.example.test.":   {"v=txtv0;to=https://upstream.canary.target.test;type=host"},
+		"_canary.invalid.example.test.":         {"v=txtv0;use=_redirect.upstream.example.test;type=path"},
+		"_redirect.docs.upstream.example.test.": {"v=txtv0;to=https://upstream.production.target.test;type=host"},
+	}
+	d := caddyfile.NewTestDispenser(`txtdirect {
+		enable host path
+		redirect https://fallback.test
+		basezone _canary.
+	}`)
+	c, err := ParseCaddy(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BaseZone != "_canary" {
+		t.Fatalf("Expected the basezone to be _canary, got %s", c.BaseZone)
+	}
+	c.Source = source
+
+	tests := []struct {
+		url      string
+		location string
+	}{
+		{
+			url:      "https://host.example.test",
+			location: "https://canary.target.test",
+		},
+		{
+			url:      "https://path.example.test/docs",
+			location: "https://docs.canary.target.test",
+		},
+		{
+			url:      "https://use.example.test/docs",
+			location: "https://upstream.canary.target.test",
+		},
+		{
+			// use= zones must be under the base zone
+			url:      "https://invalid.example.test/docs",
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, *c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+	}
+
+	d = caddyfile.NewTestDispenser(`txtdirect {
+		basezone ..
+	}`)
+	if _, err := ParseCaddy(d); err == nil {
+		t.Errorf("Expected an empty basezone to fail the config")
+	}
+}
+
+func Test_parseRegexIndex(t *testing.T) {
+	tests := []struct {
+		index    string
+		expected []string
+		err      bool
+	}{
+		{
+			index:    "3",
+			expected: []string{"1", "2", "3"},
+		},
+		{
+			index:    "docs, API,2",
+			expected: []string{"docs", "api", "2"},
+		},
+		{
+			index: "0",
+			err:   true,
+		},
+		{
+			index: "65",
+			err:   true,
+		},
+		{
+			index: "docs,,api",
+			err:   true,
+		},
+		{
+			index: "docs.v1",
+			err:   true,
+		},
+		{
+			index: "docs,DOCS",
+			err:   true,
+		},
+	}
+	for i, test := range tests {
+		index, err := parseRegexIndex(test.index)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(index, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, index)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	c := Config{Enable: []string{"path"}}
+	if _, err := ParseRecord("v=txtv0;type=path;index=3", httptest.NewRecorder(), req, c); err == nil {
+		t.Error("Expected the index= field to require re=record")
+	}
+	rec, err := ParseRecord("v=txtv0;type=path;re=record;index=2", httptest.NewRecorder(), req, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec.Index, []string{"1", "2"}) {
+		t.Errorf("Unexpected index: %v", rec.Index)
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	tests := []struct {
+		rec      Record
+		expected string
+	}{
+		{
+			rec:      Record{Version: "txtv0", To: "https://example.com/", Code: 302, Type: "host"},
+			expected: "v=txtv1;to=https://example.com/",
+		},
+		{
+			rec: Record{
+				To:      "https://example.com/search?q=a;b",
+				Code:    301,
+				Type:    "path",
+				Re:      "record",
+				Index:   []string{"1", "2", "3"},
+				Headers: map[string]string{"X-Test": "a \"b\"", "Cache-Control": "no-cache"},
+			},
+			expected: `v=txtv1;type=path;to="https://example.com/search?q=a;b";code=301;re=record;index=3;>Cache-Control=no-cache;>X-Test="a \"b\""`,
+		},
+		{
+			rec:      Record{Type: "host", Use: []string{"_redirect.a.test", "_redirect.b.test"}, Index: []string{"docs", "api"}},
+			expected: "v=txtv1;type=host;index=docs,api;use=_redirect.a.test;use=_redirect.b.test",
+		},
+		{
+			rec:      Record{Type: "gometa", To: "https://example.com/%41", Vcs: "git", Ref: true, Website: " https://example.com"},
+			expected: `v=txtv1;type=gometa;to="https://example.com/%41";ref=true;vcs=git;website=" https://example.com"`,
+		},
+	}
+	for i, test := range tests {
+		if txt := test.rec.String(); txt != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txt)
+		}
+	}
+
+	for i, headers := range []map[string]string{
+		{"X Test": "a"},
+		{"": "a"},
+		{"X-Test": "a", "x-test": "b"},
+	} {
+		if _, err := (Record{To: "https://example.com", Headers: headers}).MarshalText(); err == nil {
+			t.Errorf("Test %d: Expected the headers %v to fail", i, headers)
+		}
+	}
+}
+
+// quickRecord generates the records that ParseRecord can return
+type quickRecord struct {
+	Record
+}
+
+const quickChars = "abcXYZ019-_./:;=\"%\\ {}$?&"
+
+func quickString(r *rand.Rand, chars string, max int) string {
+	b := make([]byte, r.Intn(max+1))
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+func quickURL(r *rand.Rand) string {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     quickString(r, "abc", 5) + "example.test",
+		Path:     "/" + quickString(r, "abcXYZ019-_.;= %", 10),
+		RawQuery: url.Values{"q": []string{quickString(r, "abc;=\"% ", 6)}}.Encode(),
+	}
+	// url.Parse normalizes the URL in the same way as ParseURI
+	normalized, _ := url.Parse(u.String())
+	return normalized.String()
+}
+
+func (quickRecord) Generate(r *rand.Rand, size int) reflect.Value {
+	rec := Record{
+		Version: RecordV1,
+		To:      quickURL(r),
+		Code:    []int{301, 302, 307, 308}[r.Intn(4)],
+		Type:    []string{"host", "path", "gometa", "dockerv2"}[r.Intn(4)],
+		Ref:     r.Intn(2) == 0,
+		Headers: map[string]string{},
+	}
+	// Placeholders are replaced while parsing the record
+	noPlaceholders := strings.NewReplacer("{", "", "}", "")
+	if r.Intn(2) == 0 {
+		rec.Re = regexp.QuoteMeta(quickString(r, quickChars, size))
+	} else if r.Intn(2) == 0 {
+		rec.Re = "record"
+		rec.Index = []string{"1", "2"}
+		if r.Intn(2) == 0 {
+			rec.Index = []string{"docs", "v1", "api"}
+		}
+	}
+	if r.Intn(2) == 0 {
+		// from= can't be used together with re=
+		if rec.Re == "" {
+			rec.From = "/$1/$2"
+		}
+		rec.Root = quickURL(r)
+		rec.Website = quickURL(r)
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		rec.Use = append(rec.Use, fmt.Sprintf("_redirect.%d.%s", i, quickString(r, "abc", 5)+"example.test"))
+	}
+	if len(rec.Use) > 0 && r.Intn(2) == 0 {
+		rec.Type = ""
+	}
+	rec.Vcs = noPlaceholders.Replace(quickString(r, quickChars, size))
+	for i := r.Intn(3); i > 0; i-- {
+		rec.Headers[fmt.Sprintf("X-Test-%d", i)] = quickString(r, quickChars, size)
+	}
+	return reflect.ValueOf(quickRecord{rec})
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	c := Config{Enable: []string{"host", "path", "gometa", "dockerv2"}}
+	roundTrip := func(qr quickRecord) bool {
+		txt, err := qr.MarshalText()
+		if err != nil {
+			t.Logf("Couldn't marshal %#v: %s", qr.Record, err)
+			return false
+		}
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		rec, err := ParseRecord(string(txt), httptest.NewRecorder(), req, c)
+		if err != nil {
+			t.Logf("Couldn't parse %s: %s", txt, err)
+			return false
+		}
+		if !reflect.DeepEqual(rec, qr.Record) {
+			t.Logf("Expected %#v, got %#v", qr.Record, rec)
+			return false
+		}
+		// The canonical record is stable
+		return rec.String() == string(txt)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// regexCacheSize limits how many compiled re= patterns are kept
+const regexCacheSize = 1024
+
+// compiledRegexes keeps the compiled re= patterns of the records across
+// requests
+var compiledRegexes = newRegexCache(regexCacheSize)
+
+// regexCache is a concurrency-safe LRU cache of compiled regexes keyed by
+// their pattern. Patterns that don't compile are cached with their error.
+type regexCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type regexEntry struct {
+	pattern string
+	regex   *regexp.Regexp
+	err     error
+}
+
+func newRegexCache(size int) *regexCache {
+	return &regexCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// compileRegex returns the compiled regex of the given pattern from the cache
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	return compiledRegexes.compile(pattern)
+}
+
+func (rc *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	rc.mu.Lock()
+	if elem, ok := rc.entries[pattern]; ok {
+		rc.order.MoveToFront(elem)
+		entry := elem.Value.(*regexEntry)
+		rc.mu.Unlock()
+		return entry.regex, entry.err
+	}
+	rc.mu.Unlock()
+
+	// Compile outside of the lock, concurrent misses of the same pattern
+	// just compile it more than once
+	regex, err := regexp.Compile(pattern)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.entries[pattern]; !ok {
+		rc.entries[pattern] = rc.order.PushFront(&regexEntry{pattern: pattern, regex: regex, err: err})
+		for rc.order.Len() > rc.size {
+			last := rc.order.Back()
+			rc.order.Remove(last)
+			delete(rc.entries, last.Value.(*regexEntry).pattern)
+		}
+	}
+	return regex, err
+}
+
+func (rc *regexCache) len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.order.Len()
+}
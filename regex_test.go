@@ -0,0 +1,72 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRegexCache(t *testing.T) {
+	rc := newRegexCache(2)
+
+	first, err := rc.compile("^/a$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := rc.compile("^/a$"); again != first {
+		t.Error("Expected the compiled regex to be reused")
+	}
+
+	if _, err := rc.compile("^/(a$"); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+	if _, err := rc.compile("^/(a$"); err == nil {
+		t.Error("Expected the cached invalid pattern to fail")
+	}
+
+	// The least recently used pattern is evicted
+	rc.compile("^/a$")
+	rc.compile("^/b$")
+	if rc.len() != 2 {
+		t.Errorf("Expected 2 cached patterns, got %d", rc.len())
+	}
+	if again, _ := rc.compile("^/a$"); again != first {
+		t.Error("Expected the recently used regex to be kept")
+	}
+	if _, ok := rc.entries["^/(a$"]; ok {
+		t.Error("Expected the least recently used pattern to be evicted")
+	}
+}
+
+func TestRegexCacheConcurrent(t *testing.T) {
+	rc := newRegexCache(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pattern := fmt.Sprintf("^/(v%d)/(.*)$", i%16)
+			regex, err := rc.compile(pattern)
+			if err != nil || regex.String() != pattern {
+				t.Errorf("Unexpected regex for %s: %v %v", pattern, regex, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rc.len() > 8 {
+		t.Errorf("Expected at most 8 cached patterns, got %d", rc.len())
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsTimeout is used for queries sent to the custom resolver
+	// when the request's context doesn't have a deadline
+	dnsTimeout = 5 * time.Second
+
+	// ednsUDPSize is the EDNS0 buffer size advertised to the resolvers so
+	// long TXT records fit in UDP responses without being truncated
+	ednsUDPSize = 1232
+)
+
+// lookupTXT queries the TXT records of the given absolute zone and returns
+// them with their TTL. Each attempt is limited by the query timeout and
+// failed attempts are retried unless the record doesn't exist.
+func lookupTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	timeout := c.queryTimeout()
+	var txts []string
+	var ttl time.Duration
+	var err error
+	for attempt := 0; attempt <= c.QueryRetries; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		txts, ttl, err = lookupTXTOnce(attemptCtx, zone, c)
+		cancel()
+		if err == nil || err == ErrNotFound || ctx.Err() != nil {
+			break
+		}
+	}
+	return txts, ttl, err
+}
+
+// queryTimeout returns the time limit of each query attempt
+func (c Config) queryTimeout() time.Duration {
+	if c.QueryTimeout == 0 {
+		return dnsTimeout
+	}
+	return c.QueryTimeout
+}
+
+// lookupTXTOnce sends a single TXT lookup. The system resolver is used unless
+// custom resolvers are set in the config. The system resolver doesn't expose
+// the TTL.
+func lookupTXTOnce(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	if len(c.resolvers()) != 0 {
+		return exchangeTXT(ctx, zone, c)
+	}
+
+	txts, err := net.DefaultResolver.LookupTXT(ctx, zone)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, unknownTTL, ErrNotFound
+		}
+		return nil, 0, fmt.Errorf("could not get TXT record: %s", err)
+	}
+	if len(txts) == 0 || txts[0] == "" {
+		return nil, unknownTTL, ErrNotFound
+	}
+	return txts, unknownTTL, nil
+}
+
+// exchangeTXT sends a TXT query for the given absolute zone to the custom
+// resolvers and returns the answers with the smallest TTL among them.
+func exchangeTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeTXT)
+	// The DO bit asks for the signatures when DNSSEC is enabled
+	m.SetEdns0(ednsUDPSize, c.DNSSEC != "")
+
+	resp, err := exchangeResolvers(ctx, m, c)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get TXT record: %s", err)
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("could not get TXT record: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Only the records of the zone or the end of its CNAME chain are
+	// answers, the other records could belong to anyone's signed zone
+	owner := answerOwner(zone, resp.Answer)
+	var txts []string
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(txt.Hdr.Name, owner) {
+			continue
+		}
+		// Concatenate the strings of each record the same way net.LookupTXT does
+		txts = append(txts, strings.Join(txt.Txt, ""))
+		if len(txts) == 1 || txt.Hdr.Ttl < ttl {
+			ttl = txt.Hdr.Ttl
+		}
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		txts = nil
+	}
+
+	if c.DNSSEC != "" {
+		// Missing records must be proven too, otherwise a forged denial
+		// would send the request to the wildcard zones
+		validate := validateAnswer
+		if len(txts) == 0 {
+			validate = validateDenial
+		}
+		if err := validate(ctx, resp, c); err != nil {
+			if c.DNSSEC == DNSSECRequire {
+				return nil, 0, fmt.Errorf("could not validate TXT record: %s", err)
+			}
+			log.Printf("[txtdirect]: Couldn't validate the TXT record of %s: %s", zone, err.Error())
+		}
+	}
+
+	if len(txts) == 0 || txts[0] == "" {
+		return nil, negativeTTL(resp), ErrNotFound
+	}
+	return txts, time.Duration(ttl) * time.Second, nil
+}
+
+// answerOwner follows the CNAME chain of the given zone in the answer
+// section and returns the name at the end of the chain
+func answerOwner(zone string, answer []dns.RR) string {
+	owner := zone
+	// Every CNAME can only be followed once, which stops the loops
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, owner) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		owner = next
+	}
+	return owner
+}
+
+// negativeTTL returns how long a missing record can be cached using the
+// SOA record from the response's authority section as described in RFC 2308
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return unknownTTL
+}
+
+// exchange sends the given message to the custom resolver and returns
+// the response. Truncated responses are retried over TCP. Responses to a
+// different question are rejected.
+func exchange(ctx context.Context, m *dns.Msg, c Config) (*dns.Msg, error) {
+	var resp *dns.Msg
+	var err error
+	switch {
+	case isDoH(c.Resolver):
+		resp, err = exchangeHTTPS(ctx, m, c)
+	case isDoT(c.Resolver):
+		resp, err = exchangeConn(ctx, "tcp", m, c)
+	default:
+		resp, err = exchangeConn(ctx, "udp", m, c)
+		if err == nil && resp.Truncated {
+			resp, err = exchangeConn(ctx, "tcp", m, c)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !sameQuestion(m, resp) {
+		return nil, fmt.Errorf("the response doesn't match the question")
+	}
+	return resp, nil
+}
+
+// sameQuestion reports whether the response answers the message's question
+func sameQuestion(m, resp *dns.Msg) bool {
+	if len(resp.Question) != len(m.Question) {
+		return false
+	}
+	for i, q := range m.Question {
+		r := resp.Question[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// exchangeConn sends the message over a connection dialed by customResolver
+func exchangeConn(ctx context.Context, network string, m *dns.Msg, c Config) (*dns.Msg, error) {
+	resolver := customResolver(c)
+	conn, err := resolver.Dial(ctx, network, c.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// Unblock the connection if the request gets canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	co := &dns.Conn{Conn: conn}
+	if opt := m.IsEdns0(); opt != nil {
+		co.UDPSize = opt.UDPSize()
+	}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	resp, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
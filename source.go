@@ -0,0 +1,63 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by record sources when the
+// zone doesn't have any TXT records
+var ErrNotFound = errors.New("TXT record doesn't exist or is empty")
+
+// RecordSource finds the TXT records of an absolute zone such as
+// "_redirect.example.com." and returns them with their TTL. A negative
+// TTL means the TTL is unknown and a zero TTL disables caching.
+// ErrNotFound should be returned if the zone doesn't have any TXT records.
+type RecordSource interface {
+	LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error)
+}
+
+// DNSSource is the default record source and finds the
+// records using the resolvers set in the config
+type DNSSource struct {
+	Config Config
+}
+
+// LookupTXT sends a DNS query for the given zone. Concurrent
+// lookups for the same zone are coalesced into a single query.
+func (s DNSSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	return lookups.do(ctx, lookupKey(zone, s.Config), func() ([]string, time.Duration, error) {
+		// The query is shared by the coalesced requests, so it isn't
+		// canceled with the request that started it
+		timeout := s.Config.queryTimeout() * time.Duration(s.Config.QueryRetries+1)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return lookupTXT(ctx, zone, s.Config)
+	})
+}
+
+// source returns the record source used to find the TXT records.
+// The zone files replace DNS when they're set in the config.
+func (c Config) source() RecordSource {
+	if c.Source != nil {
+		return c.Source
+	}
+	if c.RecordsFile != nil {
+		return c.RecordsFile
+	}
+	return DNSSource{Config: c}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mapSource is a record source that serves the TXT records from a map
+type mapSource map[string][]string
+
+func (s mapSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	txts, ok := s[zone]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return txts, time.Minute, nil
+}
+
+func TestRedirectSource(t *testing.T) {
+	source := mapSource{
+		"_redirect.host.source.test.":      {"v=txtv0;to=https://host.target.test;type=host"},
+		"_redirect.path.source.test.":      {"v=txtv0;type=path;root=https://root.target.test"},
+		"_redirect.docs.path.source.test.": {"v=txtv0;to=https://docs.target.test;type=host"},
+		"_redirect.pkg.source.test.":       {"v=txtv0;to=https://github.com/example/pkg;type=gometa"},
+	}
+	tests := []struct {
+		url      string
+		location string
+		body     string
+	}{
+		{
+			url:      "https://host.source.test",
+			location: "https://host.target.test",
+		},
+		{
+			url:      "https://path.source.test/docs",
+			location: "https://docs.target.test",
+		},
+		{
+			url:      "https://path.source.test/",
+			location: "https://root.target.test",
+		},
+		{
+			url:  "https://pkg.source.test/?go-get=1",
+			body: "pkg.source.test git https://github.com/example/pkg",
+		},
+		{
+			url:      "https://missing.source.test",
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Enable:   []string{"host", "path", "gometa"},
+			Redirect: "https://fallback.test",
+			Source:   source,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+		if !strings.Contains(resp.Body.String(), test.body) {
+			t.Errorf("Test %d: Expected %s to be in the body:\n%s", i, test.body, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Record format versions
+const (
+	// RecordV0 is the original record format which splits the fields on ";"
+	RecordV0 = "txtv0"
+	// RecordV1 is the record format described in docs/record-format which
+	// supports quoted and percent-escaped values
+	RecordV1 = "txtv1"
+)
+
+// recordKeys are the fields of a TXTDirect record
+var recordKeys = map[string]bool{
+	"code":    true,
+	"from":    true,
+	"index":   true,
+	"re":      true,
+	"ref":     true,
+	"root":    true,
+	"to":      true,
+	"type":    true,
+	"use":     true,
+	"v":       true,
+	"vcs":     true,
+	"website": true,
+}
+
+// recordField is a single key=value field of a TXT record. Header fields
+// keep the ">" prefix in their key.
+type recordField struct {
+	key   string
+	value string
+	// err is set by the txtv0 tokenizer for the fields that it can't
+	// tokenize so the errors are reported in the order of the fields
+	err error
+}
+
+// tokenizeRecord splits the given TXT record into fields and returns them
+// with the record format they were tokenized with. Records that start with
+// the v=txtv1 field use the txtv1 grammar, others are tokenized as txtv0.
+func tokenizeRecord(str string) ([]recordField, string, error) {
+	first := strings.SplitN(str, ";", 2)[0]
+	if strings.TrimSpace(first) == "v="+RecordV1 {
+		fields, err := tokenizeV1(str)
+		return fields, RecordV1, err
+	}
+	return tokenizeV0(str), RecordV0, nil
+}
+
+// tokenizeV0 splits the record on ";" and each field on its first "=".
+// Header values are cut at their second "=" and percent-decoded, other
+// values are kept as they are. Unknown fields must contain a single "=".
+func tokenizeV0(str string) []recordField {
+	var fields []recordField
+	for _, l := range strings.Split(str, ";") {
+		l = strings.TrimSpace(l)
+
+		if strings.HasPrefix(l, ">") {
+			header := strings.Split(l, "=")
+			if len(header) < 2 {
+				fields = append(fields, recordField{err: fmt.Errorf("header %s doesn't have a value", l[1:])})
+				continue
+			}
+			value, err := url.PathUnescape(header[1])
+			fields = append(fields, recordField{key: header[0], value: value, err: err})
+			continue
+		}
+
+		i := strings.Index(l, "=")
+		if i < 0 || (!recordKeys[l[:i]] && strings.Count(l, "=") != 1) {
+			fields = append(fields, recordField{err: fmt.Errorf("arbitrary data not allowed")})
+			continue
+		}
+		fields = append(fields, recordField{key: l[:i], value: l[i+1:]})
+	}
+	return fields
+}
+
+// tokenizeV1 tokenizes the record using the txtv1 grammar and rejects the
+// records with duplicate fields. Only the use= field can be repeated.
+func tokenizeV1(str string) ([]recordField, error) {
+	sc := &recordScanner{s: str}
+	var fields []recordField
+	seen := map[string]bool{}
+	for {
+		sc.skipSpace()
+		if sc.done() {
+			return fields, nil
+		}
+
+		key, err := sc.key()
+		if err != nil {
+			return nil, err
+		}
+		value, err := sc.value(key)
+		if err != nil {
+			return nil, err
+		}
+
+		sc.skipSpace()
+		if !sc.done() {
+			if sc.peek() != ';' {
+				return nil, fmt.Errorf("unexpected %q after the value of %s", sc.peek(), key)
+			}
+			sc.pos++
+		}
+
+		name := key
+		if strings.HasPrefix(key, ">") {
+			name = ">" + http.CanonicalHeaderKey(key[1:])
+		}
+		if seen[name] && key != "use" {
+			return nil, fmt.Errorf("duplicate %s field", key)
+		}
+		seen[name] = true
+		fields = append(fields, recordField{key: key, value: value})
+	}
+}
+
+// recordScanner reads the fields of a txtv1 record
+type recordScanner struct {
+	s   string
+	pos int
+}
+
+func (sc *recordScanner) done() bool {
+	return sc.pos >= len(sc.s)
+}
+
+func (sc *recordScanner) peek() byte {
+	return sc.s[sc.pos]
+}
+
+func (sc *recordScanner) skipSpace() {
+	for !sc.done() && (sc.peek() == ' ' || sc.peek() == '\t') {
+		sc.pos++
+	}
+}
+
+// key reads the field's key and the "=" after it
+func (sc *recordScanner) key() (string, error) {
+	start := sc.pos
+	for !sc.done() && sc.peek() != '=' && sc.peek() != ';' {
+		sc.pos++
+	}
+	key := sc.s[start:sc.pos]
+	if sc.done() || sc.peek() != '=' {
+		if strings.TrimSpace(key) == "" {
+			return "", fmt.Errorf("empty field at position %d", start)
+		}
+		return "", fmt.Errorf("field %q doesn't have a value", key)
+	}
+	sc.pos++
+
+	name := key
+	if strings.HasPrefix(key, ">") {
+		name = key[1:]
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty key at position %d", start)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isKeyChar(name[i], strings.HasPrefix(key, ">")) {
+			return "", fmt.Errorf("invalid character %q in key %q", name[i], key)
+		}
+	}
+	return key, nil
+}
+
+// value reads a quoted or bare value. Quoted values are taken literally
+// except for the \" and \\ escapes, bare values are percent-decoded.
+func (sc *recordScanner) value(key string) (string, error) {
+	sc.skipSpace()
+	if !sc.done() && sc.peek() == '"' {
+		sc.pos++
+		var b strings.Builder
+		for !sc.done() {
+			c := sc.peek()
+			sc.pos++
+			switch c {
+			case '"':
+				return b.String(), nil
+			case '\\':
+				if sc.done() || (sc.peek() != '"' && sc.peek() != '\\') {
+					return "", fmt.Errorf("invalid escape in the value of %s", key)
+				}
+				b.WriteByte(sc.peek())
+				sc.pos++
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated quoted value of %s", key)
+	}
+
+	start := sc.pos
+	for !sc.done() && sc.peek() != ';' {
+		sc.pos++
+	}
+	raw := strings.TrimRight(sc.s[start:sc.pos], " \t")
+	if strings.Contains(raw, "\"") {
+		return "", fmt.Errorf("the value of %s must be quoted as a whole", key)
+	}
+	value, err := url.PathUnescape(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid percent-escape in the value of %s", key)
+	}
+	return value, nil
+}
+
+// formatValue returns the given value as a bare value if it can be used
+// as is, otherwise as a quoted value
+func formatValue(value string) string {
+	if !strings.ContainsAny(value, "\";%") && strings.TrimSpace(value) == value {
+		return value
+	}
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
+
+// isKeyChar reports whether c can be used in a field key. Header names
+// can use the token characters of RFC 7230.
+func isKeyChar(c byte, header bool) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		return true
+	case header:
+		return strings.IndexByte("!#$%&'*+.^`|~", c) >= 0
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_tokenizeRecord(t *testing.T) {
+	tests := []struct {
+		txt      string
+		format   string
+		expected []recordField
+		err      string
+	}{
+		{
+			txt:    "v=txtv0;to=https://example.test/?a=b;>X-Test=a%20b=c",
+			format: RecordV0,
+			expected: []recordField{
+				{key: "v", value: "txtv0"},
+				{key: "to", value: "https://example.test/?a=b"},
+				{key: ">X-Test", value: "a b"},
+			},
+		},
+		{
+			// txtv0 records are split on every ";"
+			txt:    "v=txtv0;to=https://example.test/?a=1;b=2",
+			format: RecordV0,
+			expected: []recordField{
+				{key: "v", value: "txtv0"},
+				{key: "to", value: "https://example.test/?a=1"},
+				{key: "b", value: "2"},
+			},
+		},
+		{
+			txt:    ` v=txtv1 ; to="https://example.test/?a=1;b=\"2\"" ;code=301;`,
+			format: RecordV1,
+			expected: []recordField{
+				{key: "v", value: "txtv1"},
+				{key: "to", value: `https://example.test/?a=1;b="2"`},
+				{key: "code", value: "301"},
+			},
+		},
+		{
+			txt:    "v=txtv1;to=https://example.test/?a=1%3Bb=2;>X-Test=a%20b",
+			format: RecordV1,
+			expected: []recordField{
+				{key: "v", value: "txtv1"},
+				{key: "to", value: "https://example.test/?a=1;b=2"},
+				{key: ">X-Test", value: "a b"},
+			},
+		},
+		{
+			txt:    "v=txtv1;use=_redirect.a.test;use=_redirect.b.test",
+			format: RecordV1,
+			expected: []recordField{
+				{key: "v", value: "txtv1"},
+				{key: "use", value: "_redirect.a.test"},
+				{key: "use", value: "_redirect.b.test"},
+			},
+		},
+		{
+			txt:    "v=txtv1;to=https://a.test;to=https://b.test",
+			format: RecordV1,
+			err:    "duplicate to field",
+		},
+		{
+			txt:    "v=txtv1;>x-test=a;>X-Test=b",
+			format: RecordV1,
+			err:    "duplicate >X-Test field",
+		},
+		{
+			txt:    `v=txtv1;to="https://a.test`,
+			format: RecordV1,
+			err:    "unterminated quoted value of to",
+		},
+		{
+			txt:    `v=txtv1;to="https://a.test"x`,
+			format: RecordV1,
+			err:    "unexpected 'x' after the value of to",
+		},
+		{
+			txt:    `v=txtv1;to=https://"a".test`,
+			format: RecordV1,
+			err:    "the value of to must be quoted as a whole",
+		},
+		{
+			txt:    `v=txtv1;to="\n"`,
+			format: RecordV1,
+			err:    "invalid escape in the value of to",
+		},
+		{
+			txt:    "v=txtv1;to=https://a.test/%zz",
+			format: RecordV1,
+			err:    "invalid percent-escape in the value of to",
+		},
+		{
+			txt:    "v=txtv1;https://a.test",
+			format: RecordV1,
+			err:    "field \"https://a.test\" doesn't have a value",
+		},
+		{
+			txt:    "v=txtv1;t:o=https://a.test",
+			format: RecordV1,
+			err:    "invalid character ':' in key",
+		},
+		{
+			txt:    "v=txtv1;;to=https://a.test",
+			format: RecordV1,
+			err:    "empty field",
+		},
+		{
+			txt:    "v=txtv1;to",
+			format: RecordV1,
+			err:    "field \"to\" doesn't have a value",
+		},
+	}
+	for i, test := range tests {
+		fields, format, err := tokenizeRecord(test.txt)
+		if format != test.format {
+			t.Errorf("Test %d: Expected the %s format, got %s", i, test.format, format)
+		}
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("Test %d: Expected error %q, got %v", i, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, fields)
+		}
+	}
+}
+
+func TestParseRecordV1(t *testing.T) {
+	tests := []struct {
+		txt      string
+		expected Record
+		err      string
+	}{
+		{
+			txt: `v=txtv1;to="https://example.test/search?q=a;b";code=301`,
+			expected: Record{
+				Version: RecordV1,
+				To:      "https://example.test/search?q=a;b",
+				Code:    301,
+				Type:    "host",
+				Headers: map[string]string{},
+			},
+		},
+		{
+			txt: "v=txtv1;type=path;re=^/(a%3Bb)$;>Cache-Control=no-cache",
+			expected: Record{
+				Version: RecordV1,
+				Code:    302,
+				Type:    "path",
+				Re:      "^/(a;b)$",
+				Headers: map[string]string{"Cache-Control": "no-cache"},
+			},
+		},
+		{
+			txt: "v=txtv1;to=https://example.test;key=value",
+			err: "unknown field key",
+		},
+		{
+			txt: "v=txtv1;to=https://example.test;code=301;code=302",
+			err: "duplicate code field",
+		},
+		{
+			// v=txtv1 has to be the first field
+			txt: "to=https://example.test;v=txtv1",
+			err: "unhandled version 'txtv1'",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		rec, err := ParseRecord(test.txt, httptest.NewRecorder(), req, Config{Enable: []string{"host", "path"}})
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("Test %d: Expected error %q, got %v", i, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(rec, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, rec)
+		}
+	}
+}
@@ -63,8 +63,11 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return nil
 	}
 
+	r = withQueryBudget(r, c)
+
 	rec, err := GetRecord(host, c, w, r)
 	if err != nil {
+		log.Printf("[txtdirect]: Fallback is triggered because the record couldn't be found: %s", err.Error())
 		fallback(w, r, "global", http.StatusFound, c)
 		return nil
 	}
@@ -159,11 +162,15 @@ func UpstreamZone(r *http.Request) string {
 
 // customResolver returns a net.Resolver instance based
 // on the given txtdirect config to use a custom DNS resolver.
+// DNS-over-TLS resolvers are dialed over TLS.
 func customResolver(c Config) net.Resolver {
 	return net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{}
+			if isDoT(c.Resolver) {
+				return dialTLS(ctx, &d, c)
+			}
 			return d.DialContext(ctx, network, c.Resolver)
 		},
 	}
@@ -16,6 +16,7 @@ package txtdirect
 import (
 	"context"
 	"log"
+	"net"
 	"net/http/httptest"
 	"os"
 	"strconv"
@@ -37,6 +38,10 @@ var txts = map[string]string{
 	// query() function test records
 	"_redirect.about.host.host.example.com.":   "v=txtv0;to=https://about.txtdirect.org",
 	"_redirect.pkg.gometa.gometa.example.com.": "v=txtv0;to=https://pkg.txtdirect.org;type=gometa",
+
+	// Longer than a single character-string
+	"_redirect.long.host.host.example.com.": "v=txtv0;to=https://long.txtdirect.org/" +
+		strings.Repeat("segment/", 40) + "?q=" + strings.Repeat("a", 100) + ";type=host;>X-Long=" + strings.Repeat("b", 300),
 }
 
 // Testing DNS server port
@@ -46,7 +51,10 @@ const port = 6000
 var server = &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
 
 func TestMain(m *testing.M) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go RunDNSServer()
+	<-started
 	os.Exit(m.Run())
 }
 
@@ -76,6 +84,10 @@ func Test_query(t *testing.T) {
 			"_redirect.pkg.gometa.gometa.example.com.",
 			txts["_redirect.pkg.gometa.gometa.example.com."],
 		},
+		{
+			"_redirect.long.host.host.example.com.",
+			txts["_redirect.long.host.host.example.com."],
+		},
 	}
 	for _, test := range tests {
 		ctx := context.Background()
@@ -99,12 +111,22 @@ func parseDNSQuery(m *dns.Msg) {
 			log.Printf("Query for %s\n", q.Name)
 			m.Answer = append(m.Answer, &dns.TXT{
 				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
-				Txt: []string{txts[q.Name]},
+				Txt: splitTXT(txts[q.Name]),
 			})
 		}
 	}
 }
 
+// splitTXT splits the record into character-strings of at most 255 bytes
+func splitTXT(txt string) []string {
+	var strs []string
+	for len(txt) > 255 {
+		strs = append(strs, txt[:255])
+		txt = txt[255:]
+	}
+	return append(strs, txt)
+}
+
 func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -118,6 +140,24 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(m)
 }
 
+// newTestDNSServer starts a UDP DNS server using the given handler
+// and returns its address
+func newTestDNSServer(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
 func RunDNSServer() {
 	dns.HandleFunc("example.com.", handleDNSRequest)
 	err := server.ListenAndServe()
@@ -0,0 +1,282 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity tells whether a problem makes the record invalid
+type Severity string
+
+// Problem severities
+const (
+	// SeverityError is used for the problems that make the record invalid
+	SeverityError Severity = "error"
+	// SeverityWarning is used for the problems that don't stop the record
+	// from being used
+	SeverityWarning Severity = "warning"
+)
+
+// Problem codes identify the kind of a problem for the tools that use
+// the validation results
+const (
+	ProblemRecordTooLong      = "record-too-long"
+	ProblemSyntax             = "syntax"
+	ProblemUnknownField       = "unknown-field"
+	ProblemMissingVersion     = "missing-version"
+	ProblemInvalidVersion     = "invalid-version"
+	ProblemDeprecatedVersion  = "deprecated-version"
+	ProblemInvalidCode        = "invalid-code"
+	ProblemNonRedirectCode    = "non-redirect-code"
+	ProblemInvalidRef         = "invalid-ref"
+	ProblemInvalidURL         = "invalid-url"
+	ProblemInvalidRegex       = "invalid-regex"
+	ProblemRegexWithFrom      = "regex-with-from"
+	ProblemInvalidIndex       = "invalid-index"
+	ProblemInvalidUse         = "invalid-use"
+	ProblemMissingTo          = "missing-to"
+	ProblemTypeNotEnabled     = "type-not-enabled"
+	ProblemInvalidHeader      = "invalid-header"
+	ProblemInvalidZoneFile    = "invalid-zone-file"
+	ProblemMissingRecord      = "missing-record"
+	ProblemConflictingRecords = "conflicting-records"
+	ProblemMissingUse         = "missing-use"
+	ProblemMissingSubzone     = "missing-subzone"
+	ProblemExtraSubzone       = "extra-subzone"
+	ProblemUnreachableSubzone = "unreachable-subzone"
+	ProblemNoChildren         = "no-children"
+)
+
+// Problem is an issue found while validating a record. Field is the key of
+// the field that has the problem or empty for the whole record.
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Field    string   `json:"field,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Field == "" {
+		return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Field, p.Message)
+}
+
+// HasErrors reports whether any of the given problems is an error
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func errorProblem(code, field, format string, args ...interface{}) Problem {
+	return Problem{Severity: SeverityError, Code: code, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+func warningProblem(code, field, format string, args ...interface{}) Problem {
+	return Problem{Severity: SeverityWarning, Code: code, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// ValidateRecord decodes the given TXT record without evaluating its
+// placeholders and returns the record with every problem found in it.
+// Unlike ParseRecord it doesn't need a request and never writes a response.
+func ValidateRecord(txt string, c Config) (Record, []Problem) {
+	if len(txt) > maxRecordLength {
+		return Record{}, []Problem{errorProblem(ProblemRecordTooLong, "", "TXT record cannot exceed the maximum of %d characters", maxRecordLength)}
+	}
+	fields, format, err := tokenizeRecord(txt)
+	if err != nil {
+		return Record{}, []Problem{errorProblem(ProblemSyntax, "", "%s", err.Error())}
+	}
+
+	var problems []Problem
+	rec := Record{
+		Headers: map[string]string{},
+	}
+	for _, f := range fields {
+		if f.err != nil {
+			problems = append(problems, errorProblem(ProblemSyntax, f.key, "%s", f.err.Error()))
+			continue
+		}
+
+		switch f.key {
+		case "code":
+			code, err := strconv.Atoi(f.value)
+			if err != nil {
+				problems = append(problems, errorProblem(ProblemInvalidCode, f.key, "could not parse status code: %s", f.value))
+				continue
+			}
+			rec.Code = code
+		case "from":
+			rec.From = f.value
+		case "index":
+			index, err := parseRegexIndex(f.value)
+			if err != nil {
+				problems = append(problems, errorProblem(ProblemInvalidIndex, f.key, "%s", err.Error()))
+				continue
+			}
+			rec.Index = index
+		case "re":
+			rec.Re = f.value
+		case "ref":
+			ref, err := strconv.ParseBool(f.value)
+			if err != nil {
+				problems = append(problems, errorProblem(ProblemInvalidRef, f.key, "could not parse ref: %s", f.value))
+				continue
+			}
+			rec.Ref = ref
+		case "root":
+			rec.Root = f.value
+		case "to":
+			rec.To = f.value
+		case "type":
+			rec.Type = f.value
+		case "use":
+			rec.Use = append(rec.Use, f.value)
+		case "v":
+			rec.Version = f.value
+			if rec.Version == RecordV1 && format != RecordV1 {
+				problems = append(problems, errorProblem(ProblemInvalidVersion, f.key, "v=txtv1 must be the first field of the record"))
+			}
+		case "vcs":
+			rec.Vcs = f.value
+		case "website":
+			rec.Website = f.value
+		default:
+			if strings.HasPrefix(f.key, ">") {
+				rec.Headers[f.key[1:]] = f.value
+				continue
+			}
+			if format == RecordV1 {
+				problems = append(problems, errorProblem(ProblemUnknownField, f.key, "unknown field %s", f.key))
+				continue
+			}
+			problems = append(problems, warningProblem(ProblemUnknownField, f.key, "unknown field %s is ignored", f.key))
+		}
+	}
+
+	// Apply the same defaults as ParseRecord
+	if rec.Code == 0 {
+		rec.Code = http.StatusFound
+	}
+	if rec.Type == "" && len(rec.Use) == 0 {
+		rec.Type = "host"
+	}
+
+	return rec, append(problems, rec.Validate(c)...)
+}
+
+// Validate returns the problems of the record's fields for the given
+// config. The placeholders in the record are not evaluated.
+func (rec Record) Validate(c Config) []Problem {
+	var problems []Problem
+
+	switch rec.Version {
+	case RecordV1:
+	case RecordV0:
+		problems = append(problems, warningProblem(ProblemDeprecatedVersion, "v", "txtv0 is not suitable for production"))
+	case "":
+		problems = append(problems, warningProblem(ProblemMissingVersion, "v", "the record doesn't have a v= field"))
+	default:
+		problems = append(problems, errorProblem(ProblemInvalidVersion, "v", "unhandled version '%s'", rec.Version))
+	}
+
+	if rec.Code != 0 && (rec.Code < 300 || rec.Code > 399) {
+		problems = append(problems, warningProblem(ProblemNonRedirectCode, "code", "%d is not a redirect status code", rec.Code))
+	}
+
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"to", rec.To},
+		{"root", rec.Root},
+		{"website", rec.Website},
+	} {
+		if field.value == "" {
+			continue
+		}
+		// Placeholders are replaced with a sample value to check the URL
+		if _, err := url.Parse(PlaceholderRegex.ReplaceAllString(field.value, "placeholder")); err != nil {
+			problems = append(problems, errorProblem(ProblemInvalidURL, field.key, "invalid URL: %s", err.Error()))
+		}
+	}
+
+	if rec.Re != "" && rec.Re != "record" {
+		if _, err := compileRegex(rec.Re); err != nil {
+			problems = append(problems, errorProblem(ProblemInvalidRegex, "re", "couldn't compile the regex: %s", err.Error()))
+		}
+	}
+	// Redirect always falls back on the records that use both
+	if rec.Re != "" && rec.From != "" {
+		problems = append(problems, errorProblem(ProblemRegexWithFrom, "from", "from= field can't be used together with re="))
+	}
+	if len(rec.Index) > 0 && rec.Re != "record" {
+		problems = append(problems, errorProblem(ProblemInvalidIndex, "index", "index= field can only be used with re=record"))
+	}
+	if len(rec.Index) > maxRegexIndex {
+		problems = append(problems, errorProblem(ProblemInvalidIndex, "index", "index= field can't list more than %d subzones", maxRegexIndex))
+	}
+
+	for _, use := range rec.Use {
+		if !strings.HasPrefix(use, c.baseZone()+".") {
+			problems = append(problems, errorProblem(ProblemInvalidUse, "use", "%s must be a subzone of %s", use, c.baseZone()))
+		}
+	}
+
+	if rec.Type == "dockerv2" && rec.To == "" {
+		problems = append(problems, errorProblem(ProblemMissingTo, "to", "to= field is required in dockerv2 type"))
+	}
+	if len(rec.Use) == 0 {
+		recType := rec.Type
+		if recType == "" {
+			recType = "host"
+		}
+		if recType == "host" && rec.To == "" {
+			problems = append(problems, errorProblem(ProblemMissingTo, "to", "to= field is required in host type"))
+		}
+		if !contains(c.Enable, recType) {
+			problems = append(problems, errorProblem(ProblemTypeNotEnabled, "type", "%s type is not enabled in configuration", recType))
+		}
+	}
+
+	headers := make([]string, 0, len(rec.Headers))
+	for header := range rec.Headers {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	for _, header := range headers {
+		if header == "" {
+			problems = append(problems, errorProblem(ProblemInvalidHeader, ">", "header names can't be empty"))
+		}
+		for i := 0; i < len(header); i++ {
+			if !isKeyChar(header[i], true) {
+				problems = append(problems, errorProblem(ProblemInvalidHeader, ">"+header, "invalid character %q in header name", header[i]))
+				break
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestValidateRecord(t *testing.T) {
+	c := Config{Enable: []string{"host", "path", "gometa"}}
+	tests := []struct {
+		txt      string
+		problems []Problem
+	}{
+		{
+			txt: "v=txtv1;to=https://example.test",
+		},
+		{
+			txt: "v=txtv1;to=https://{label1}.example.test/{uri}",
+		},
+		{
+			txt: "v=txtv0;to=https://example.test;key=value",
+			problems: []Problem{
+				{SeverityWarning, ProblemUnknownField, "key", "unknown field key is ignored"},
+				{SeverityWarning, ProblemDeprecatedVersion, "v", "txtv0 is not suitable for production"},
+			},
+		},
+		{
+			// Every problem is reported, ref= doesn't trigger the fallback
+			txt: "v=txtv0;to=https://example.test;code=abc;ref=maybe;https://example.test",
+			problems: []Problem{
+				{SeverityError, ProblemInvalidCode, "code", "could not parse status code: abc"},
+				{SeverityError, ProblemInvalidRef, "ref", "could not parse ref: maybe"},
+				{SeverityError, ProblemSyntax, "", "arbitrary data not allowed"},
+				{SeverityWarning, ProblemDeprecatedVersion, "v", "txtv0 is not suitable for production"},
+			},
+		},
+		{
+			txt: "v=txtv1;type=host;code=200",
+			problems: []Problem{
+				{SeverityWarning, ProblemNonRedirectCode, "code", "200 is not a redirect status code"},
+				{SeverityError, ProblemMissingTo, "to", "to= field is required in host type"},
+			},
+		},
+		{
+			txt: "v=txtv1;type=dockerv2",
+			problems: []Problem{
+				{SeverityError, ProblemMissingTo, "to", "to= field is required in dockerv2 type"},
+				{SeverityError, ProblemTypeNotEnabled, "type", "dockerv2 type is not enabled in configuration"},
+			},
+		},
+		{
+			txt: "v=txtv1;type=path;re=^/(a;index=2;use=_redirect.a.test;use=example.test",
+			problems: []Problem{
+				{SeverityError, ProblemInvalidRegex, "re", "couldn't compile the regex: error parsing regexp: missing closing ): `^/(a`"},
+				{SeverityError, ProblemInvalidIndex, "index", "index= field can only be used with re=record"},
+				{SeverityError, ProblemInvalidUse, "use", "example.test must be a subzone of _redirect"},
+			},
+		},
+		{
+			txt: "v=txtv1;to=https://example.test;website=http://[::1;unknown=1",
+			problems: []Problem{
+				{SeverityError, ProblemUnknownField, "unknown", "unknown field unknown"},
+				{SeverityError, ProblemInvalidURL, "website", "invalid URL: parse \"http://[::1\": missing ']' in host"},
+			},
+		},
+		{
+			txt: "to=https://example.test;v=txtv1",
+			problems: []Problem{
+				{SeverityError, ProblemInvalidVersion, "v", "v=txtv1 must be the first field of the record"},
+			},
+		},
+		{
+			txt: "v=txtv2;to=https://example.test",
+			problems: []Problem{
+				{SeverityError, ProblemInvalidVersion, "v", "unhandled version 'txtv2'"},
+			},
+		},
+		{
+			txt: "v=txtv1;to=https://example.test;to=https://example.test",
+			problems: []Problem{
+				{SeverityError, ProblemSyntax, "", "duplicate to field"},
+			},
+		},
+		{
+			txt: "v=txtv1;to=https://example.test/" + strings.Repeat("a", maxRecordLength),
+			problems: []Problem{
+				{SeverityError, ProblemRecordTooLong, "", "TXT record cannot exceed the maximum of 4096 characters"},
+			},
+		},
+	}
+	for i, test := range tests {
+		_, problems := ValidateRecord(test.txt, c)
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.problems, problems)
+		}
+		if HasErrors(problems) != HasErrors(test.problems) {
+			t.Errorf("Test %d: Unexpected HasErrors result", i)
+		}
+	}
+}
+
+func TestRecordValidate(t *testing.T) {
+	c := Config{Enable: []string{"host"}, BaseZone: "_txtdirect"}
+	rec := Record{
+		Version: RecordV1,
+		To:      "https://example.test",
+		Use:     []string{"_redirect.example.test"},
+		Index:   []string{"1"},
+		Headers: map[string]string{"X Test": "a", "": "b"},
+	}
+	expected := []Problem{
+		{SeverityError, ProblemInvalidIndex, "index", "index= field can only be used with re=record"},
+		{SeverityError, ProblemInvalidUse, "use", "_redirect.example.test must be a subzone of _txtdirect"},
+		{SeverityError, ProblemInvalidHeader, ">", "header names can't be empty"},
+		{SeverityError, ProblemInvalidHeader, ">X Test", "invalid character ' ' in header name"},
+	}
+	if problems := rec.Validate(c); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+}
+
+func TestValidateRecordRoundTrip(t *testing.T) {
+	c := Config{Enable: []string{"host", "path", "gometa", "dockerv2"}}
+	validate := func(qr quickRecord) bool {
+		rec, problems := ValidateRecord(qr.String(), c)
+		if len(problems) != 0 {
+			t.Logf("Unexpected problems in %s: %v", qr.String(), problems)
+			return false
+		}
+		return reflect.DeepEqual(rec, qr.Record)
+	}
+	if err := quick.Check(validate, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
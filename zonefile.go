@@ -0,0 +1,170 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fileCheckInterval is how often the zone files are checked for changes
+const fileCheckInterval = time.Second
+
+// ZoneFile is an RFC 1035 zone file and the origin
+// used for the relative names inside the file
+type ZoneFile struct {
+	Path   string `json:"path"`
+	Origin string `json:"origin,omitempty"`
+}
+
+// FileSource is a record source that serves the TXT records from zone
+// files instead of DNS. The zone files are reloaded when they change.
+// The records are already in memory, so they're returned with a zero TTL
+// and aren't kept in the record cache, which makes the reloads visible
+// right away. The $INCLUDE directive isn't allowed since the changes of
+// the included files wouldn't be noticed.
+type FileSource struct {
+	Zones []ZoneFile `json:"zones"`
+
+	mu       sync.Mutex
+	records  map[string]*fileRecords
+	modTimes []time.Time
+	checked  time.Time
+}
+
+// fileRecords keeps the TXT records of a name from the zone files
+type fileRecords struct {
+	txts []string
+}
+
+// LookupTXT returns the TXT records of the given zone from the zone files
+func (s *FileSource) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	records, err := s.load()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get TXT record: %s", err)
+	}
+	rec, ok := records[strings.ToLower(dns.Fqdn(zone))]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return copyTXTs(rec.txts), 0, nil
+}
+
+// load returns the records from the zone files and reloads them if any
+// of the files has changed. The previous records are kept if a reload fails.
+func (s *FileSource) load() (map[string]*fileRecords, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.records != nil && time.Since(s.checked) < fileCheckInterval {
+		return s.records, nil
+	}
+	s.checked = time.Now()
+
+	modTimes, err := zoneModTimes(s.Zones)
+	if err == nil && s.records != nil && equalTimes(modTimes, s.modTimes) {
+		return s.records, nil
+	}
+
+	var records map[string]*fileRecords
+	if err == nil {
+		records, err = readZoneFiles(s.Zones)
+	}
+	if err != nil {
+		if s.records != nil {
+			log.Printf("[txtdirect]: Couldn't reload the zone files, using the previous records: %s", err.Error())
+			return s.records, nil
+		}
+		return nil, err
+	}
+
+	if s.records != nil {
+		log.Printf("[txtdirect]: Reloaded the records from the zone files")
+	}
+	s.records, s.modTimes = records, modTimes
+	return records, nil
+}
+
+// readZoneFiles reads the TXT records from the given zone files
+func readZoneFiles(zones []ZoneFile) (map[string]*fileRecords, error) {
+	records := make(map[string]*fileRecords)
+	for _, zone := range zones {
+		f, err := os.Open(zone.Path)
+		if err != nil {
+			return nil, err
+		}
+		err = parseZoneFile(f, zone, records)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// parseZoneFile adds the TXT records of the given zone file to records
+func parseZoneFile(r io.Reader, zone ZoneFile, records map[string]*fileRecords) error {
+	zp := dns.NewZoneParser(r, dns.Fqdn(zone.Origin), zone.Path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		txt, isTXT := rr.(*dns.TXT)
+		if !isTXT {
+			continue
+		}
+		name := strings.ToLower(txt.Hdr.Name)
+		rec, found := records[name]
+		if !found {
+			rec = &fileRecords{}
+			records[name] = rec
+		}
+		rec.txts = append(rec.txts, strings.Join(txt.Txt, ""))
+	}
+
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("couldn't parse the zone file: %s", err.Error())
+	}
+	return nil
+}
+
+// zoneModTimes returns the modification time of each zone file
+func zoneModTimes(zones []ZoneFile) ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, zone := range zones {
+		info, err := os.Stat(zone.Path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestFileSource(t *testing.T) {
+	source := &FileSource{
+		Zones: []ZoneFile{{Path: "e2e/host/zonefile", Origin: "example.com"}},
+	}
+	tests := []struct {
+		zone     string
+		expected string
+		err      error
+	}{
+		{
+			zone:     "_redirect.to.host.host.example.com.",
+			expected: "v=txtv0;to=https://to-redirect.host.host.example.com;type=host;code=302",
+		},
+		{
+			zone:     "_REDIRECT.nocode.host.host.example.com.",
+			expected: "v=txtv0;to=https://nocode.host.host.example.com;type=host",
+		},
+		{
+			zone: "_redirect.missing.host.host.example.com.",
+			err:  ErrNotFound,
+		},
+		{
+			// Only TXT records are served
+			zone: "to.host.host.example.com.",
+			err:  ErrNotFound,
+		},
+	}
+	for i, test := range tests {
+		txts, ttl, err := source.LookupTXT(context.Background(), test.zone)
+		if err != test.err {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if len(txts) != 1 || txts[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %v", i, test.expected, txts)
+		}
+		// The records aren't cached
+		if ttl != 0 {
+			t.Errorf("Test %d: Expected a zero TTL, got %s", i, ttl)
+		}
+	}
+}
+
+func TestFileSourceReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "txtdirect-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	modTime := time.Now()
+	write := func(content string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the modification time changes between the writes
+		modTime = modTime.Add(time.Minute)
+		os.Chtimes(f.Name(), modTime, modTime)
+	}
+
+	source := &FileSource{Zones: []ZoneFile{{Path: f.Name(), Origin: "reload.test."}}}
+	// The reloads should be visible through the record cache too
+	c := Config{Cache: &Cache{}, Source: source}
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{
+			content:  `_redirect 60 IN TXT "v=txtv0;to=https://first.test"`,
+			expected: "v=txtv0;to=https://first.test",
+		},
+		{
+			content:  `_redirect 60 IN TXT "v=txtv0;to=https://second.test"`,
+			expected: "v=txtv0;to=https://second.test",
+		},
+		{
+			// Broken zone files shouldn't replace the loaded records
+			content:  `_redirect 60 IN TXT "v=txtv0;to=https://broken.test`,
+			expected: "v=txtv0;to=https://second.test",
+		},
+	}
+	for i, test := range tests {
+		write(test.content)
+		// Skip the check interval
+		source.checked = time.Time{}
+
+		txts, err := query("_redirect.reload.test.", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if txts[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txts[0])
+		}
+	}
+}
+
+func TestFileSourceInclude(t *testing.T) {
+	f, err := ioutil.TempFile("", "txtdirect-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("$INCLUDE e2e/host/zonefile\n")
+	f.Close()
+
+	source := &FileSource{Zones: []ZoneFile{{Path: f.Name(), Origin: "example.com."}}}
+	if _, _, err := source.LookupTXT(context.Background(), "_redirect.to.host.host.example.com."); err == nil {
+		t.Errorf("Expected the $INCLUDE directive to fail the zone file")
+	}
+}
+
+func TestRedirectFileSource(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`txtdirect {
+		enable host
+		redirect https://fallback.test
+		records_file e2e/host/zonefile example.com
+	}`)
+	c, err := ParseCaddy(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		location string
+	}{
+		{
+			url:      "https://to.host.host.example.com",
+			location: "https://to-redirect.host.host.example.com",
+		},
+		{
+			url:      "https://missing.host.host.example.com",
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, *c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location to be %s, got %s", i, test.location, location)
+		}
+	}
+
+	d = caddyfile.NewTestDispenser(`txtdirect {
+		records_file e2e/missing/zonefile example.com
+	}`)
+	if _, err := ParseCaddy(d); err == nil {
+		t.Errorf("Expected missing zone files to fail the config")
+	}
+}